@@ -0,0 +1,67 @@
+package wgthrottler
+
+import (
+	"time"
+)
+
+// AdaptiveController decides a throttler's max from the outcome of each task, as set via WithAdaptive.
+type AdaptiveController interface {
+	// Adjust is called each time a task returns its slot with the current max, how long the task ran, or 0 if that
+	// is unknown, and the error it finished with, if any, and returns the new max. Returning the current max leaves it unchanged.
+	Adjust(max int, took time.Duration, err error) int
+}
+
+// AIMD is an AdaptiveController which grows max additively while tasks are healthy and cuts it multiplicatively
+// as soon as one is not, in the manner of TCP congestion control. A task is healthy if it finished without an error
+// and, when Target is set, within Target. Max grows by one after every max healthy tasks in a row, so that it grows
+// by about one for each round of work at the current limit. When Target is set, a task reported without a duration,
+// as by a plain Done, can't be judged healthy and leaves max unchanged unless it failed.
+// An AIMD keeps state between calls and must not be shared between throttlers.
+//  Min - Least max to back off to, treated as 1 if less
+//  Max - Greatest max to grow to
+//  Target - Longest a healthy task may run, 0 to judge tasks by their errors alone
+//  Backoff - Factor max is multiplied by after an unhealthy task, between 0 and 1
+//  healthy - Number of healthy tasks since max was last changed
+type AIMD struct {
+	Min     int
+	Max     int
+	Target  time.Duration
+	Backoff float64
+	healthy int
+}
+
+// NewAIMD returns an AIMD controller keeping max between min and max, halving it whenever a task fails or runs longer than target.
+func NewAIMD(min, max int, target time.Duration) *AIMD {
+	return &AIMD{
+		Min:     min,
+		Max:     max,
+		Target:  target,
+		Backoff: 0.5,
+	}
+}
+
+// Adjust implements AdaptiveController.
+func (a *AIMD) Adjust(max int, took time.Duration, err error) int {
+	if err != nil || (a.Target > 0 && took > a.Target) {
+		a.healthy = 0
+		next := int(float64(max) * a.Backoff)
+		if next < a.Min {
+			next = a.Min
+		}
+		// a throttler can't run with a max below 1
+		if next < 1 {
+			next = 1
+		}
+		return next
+	}
+	if a.Target > 0 && took == 0 {
+		return max
+	}
+
+	a.healthy++
+	if a.healthy < max || max >= a.Max {
+		return max
+	}
+	a.healthy = 0
+	return max + 1
+}
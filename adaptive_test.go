@@ -0,0 +1,101 @@
+package wgthrottler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAIMD(t *testing.T) {
+	a := NewAIMD(1, 3, 10*time.Millisecond)
+	max := 2
+	for i := 0; i < 2; i++ {
+		max = a.Adjust(max, time.Millisecond, nil)
+	}
+	if max != 3 {
+		t.Fatalf("expected max to grow by one after a round of healthy tasks, got %d", max)
+	}
+	for i := 0; i < 10; i++ {
+		max = a.Adjust(max, time.Millisecond, nil)
+	}
+	if max != 3 {
+		t.Fatalf("expected max to stay within its bound, got %d", max)
+	}
+	if max = a.Adjust(max, 20*time.Millisecond, nil); max != 1 {
+		t.Errorf("expected a slow task to halve max, got %d", max)
+	}
+	if max = a.Adjust(max, time.Millisecond, errors.New("boom")); max != 1 {
+		t.Errorf("expected max to back off no further than its minimum, got %d", max)
+	}
+}
+
+func TestAIMDUnknownDuration(t *testing.T) {
+	a := NewAIMD(0, 4, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if max := a.Adjust(1, 0, nil); max != 1 {
+			t.Fatalf("expected a task without a duration to leave max unchanged, got %d", max)
+		}
+	}
+	if max := a.Adjust(1, 0, errors.New("boom")); max != 1 {
+		t.Errorf("expected backing off to stop at 1 below a minimum of 0, got %d", max)
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	th := NewThrottler(4, WithAdaptive(NewAIMD(1, 4, 10*time.Millisecond)))
+	user := use(t, th)
+	for i := 0; i < 3; i++ {
+		th.Next(user)
+	}
+
+	// the slow task halves max while two others are still running, which must be allowed to finish
+	th.DoneErr(user, 20*time.Millisecond, nil)
+	if s := th.String(); s != "WgThrottler{total: 2/2, users: 1, state: running}" {
+		t.Fatalf("expected max to back off to 2, got %s", s)
+	}
+	if err := th.TryNext(user); err != ErrWouldBlock {
+		t.Fatalf("expected no slot while the in-flight work exceeds max, got %v", err)
+	}
+	if err := th.DoneErr(user, time.Millisecond, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	// a plain Done reports no duration, so the task can't be judged against Target and leaves max as it is
+	th.Done(user)
+	if s := th.String(); s != "WgThrottler{total: 0/1, users: 1, state: running}" {
+		t.Errorf("expected max to back off to 1 and stay there after a task without a duration, got %s", s)
+	}
+}
+
+// recordingController records the durations reported to it, leaving max unchanged.
+type recordingController struct {
+	took chan time.Duration
+}
+
+func (r *recordingController) Adjust(max int, took time.Duration, err error) int {
+	r.took <- took
+	return max
+}
+
+func TestAdaptiveTimesEachTask(t *testing.T) {
+	rec := &recordingController{took: make(chan time.Duration, 2)}
+	th := NewThrottler(2, WithAdaptive(rec))
+	clock := useFakeClock(th)
+	user := use(t, th)
+
+	// a slow task starts first and a fast one a second later; each must be timed from its own start
+	slow, fast := make(chan struct{}), make(chan struct{})
+	th.Go(user, func(context.Context) { <-slow })
+	clock.Advance(time.Second)
+	th.Go(user, func(context.Context) { <-fast })
+	clock.Advance(time.Millisecond)
+	close(fast)
+	if took := <-rec.took; took != time.Millisecond {
+		t.Errorf("expected the fast task to report 1ms, got %v", took)
+	}
+	clock.Advance(10 * time.Second)
+	close(slow)
+	if took := <-rec.took; took != 11*time.Second+time.Millisecond {
+		t.Errorf("expected the slow task to report 11.001s, got %v", took)
+	}
+}
@@ -0,0 +1,155 @@
+package wgthrottler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// PanicError is reported in place of a task which panicked.
+//  Value - The value recovered from the panic
+//  Stack - The stack trace of the panicking goroutine
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("wgthrottler: task panicked: %v", e.Value)
+}
+
+// Do runs each of the given tasks in its own goroutine, bounded by the throttler, and blocks until all of them are complete.
+// The tasks are run on behalf of a new user which is unregistered again once Do returns, so they share the pool fairly with other users.
+// A panicking task is recovered and reported as a *PanicError. If ctx is canceled, tasks which have not yet started are skipped,
+// while those already running keep their slots until they finish.
+// The returned error joins every error encountered, or is nil if all tasks ran to completion.
+//	err := wg.Do(ctx,
+//	    func() { fetch("a") },
+//	    func() { fetch("b") },
+//	)
+func (wg *WgThrottler) Do(ctx context.Context, tasks ...func()) error {
+	user, err := wg.Use()
+	if err != nil {
+		return err
+	}
+	defer wg.ReleaseUser(user)
+
+	// ctx only ends the batch's waits: a user derived from it via UseFrom would have the slots of running tasks
+	// returned on cancellation, letting other work take them while the tasks are still running
+	batch, cancel := context.WithCancel(user)
+	defer cancel()
+	defer context.AfterFunc(ctx, cancel)()
+
+	var (
+		mu      sync.Mutex
+		errs    []error
+		running sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+
+	for _, task := range tasks {
+		if err := ctx.Err(); err != nil {
+			fail(err)
+			break
+		}
+		if err := wg.Next(batch); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			fail(err)
+			break
+		}
+		running.Add(1)
+		start := wg.clock()
+		go func(task func()) {
+			defer running.Done()
+			err := protect(func() error {
+				task()
+				return nil
+			})
+			wg.DoneErr(user, wg.clock().Sub(start), err)
+			if err != nil {
+				fail(err)
+			}
+		}(task)
+	}
+
+	running.Wait()
+	return errors.Join(errs...)
+}
+
+// DoReport runs each of the given tasks in its own goroutine, bounded by the throttler, as for Do, but stops starting
+// further tasks as soon as one of them fails, and reports the outcome of every task individually rather than joined.
+// Entry i of the returned slice is the error returned by task i, a *PanicError if it panicked, or nil if it succeeded.
+// Tasks which were never started, because an earlier task failed or ctx was canceled first, are reported as ErrNotRun,
+// except that a task whose slot could not be acquired for any other reason, such as ErrClosed, reports that error instead.
+// Tasks already running when the batch is canceled are left to finish, holding their slots until they do,
+// and DoReport waits for them before returning.
+//	errs := wg.DoReport(ctx, uploads...)
+//	for i, err := range errs {
+//	    if errors.Is(err, wgthrottler.ErrNotRun) { ... }
+//	}
+func (wg *WgThrottler) DoReport(ctx context.Context, tasks ...func() error) []error {
+	errs := make([]error, len(tasks))
+	user, err := wg.Use()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer wg.ReleaseUser(user)
+
+	// canceling the waits rather than the user itself leaves the slots of running tasks held until they finish,
+	// whether the batch is canceled by a failing task or by ctx
+	batch, cancel := context.WithCancel(user)
+	defer cancel()
+	defer context.AfterFunc(ctx, cancel)()
+
+	var running sync.WaitGroup
+	for i, task := range tasks {
+		// ctx is checked directly as well, since its cancellation only reaches batch asynchronously
+		err := ctx.Err()
+		if err == nil {
+			err = wg.Next(batch)
+		}
+		if err != nil {
+			if batch.Err() == nil && ctx.Err() == nil {
+				errs[i] = err
+				i++
+			}
+			for ; i < len(tasks); i++ {
+				errs[i] = ErrNotRun
+			}
+			break
+		}
+		running.Add(1)
+		start := wg.clock()
+		go func(i int, task func() error) {
+			defer running.Done()
+			if errs[i] = protect(task); errs[i] != nil {
+				cancel()
+			}
+			wg.DoneErr(user, wg.clock().Sub(start), errs[i])
+		}(i, task)
+	}
+
+	running.Wait()
+	return errs
+}
+
+// protect runs fn, reporting a panic as a *PanicError instead of propagating it.
+func protect(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
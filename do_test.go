@@ -0,0 +1,212 @@
+package wgthrottler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	th := NewThrottler(3)
+	var running, peak, ran int64
+	tasks := make([]func(), 10)
+	for i := range tasks {
+		tasks[i] = func() {
+			raisePeak(&peak, atomic.AddInt64(&running, 1))
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&running, -1)
+			atomic.AddInt64(&ran, 1)
+		}
+	}
+
+	if err := th.Do(context.Background(), tasks...); err != nil {
+		t.Fatalf("unexpected error from Do: %v", err)
+	}
+	if ran != 10 {
+		t.Errorf("expected all 10 tasks to run, %d did", ran)
+	}
+	if peak > 3 {
+		t.Errorf("expected at most 3 concurrent tasks, saw %d", peak)
+	}
+	if n := len(th.cMap); n != 0 {
+		t.Errorf("expected Do to unregister its user, %d remain", n)
+	}
+}
+
+func TestDoRecoversPanics(t *testing.T) {
+	th := NewThrottler(2)
+	err := th.Do(context.Background(),
+		func() {},
+		func() { panic("boom") },
+	)
+
+	var perr *PanicError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a *PanicError, got %v", err)
+	}
+	if perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Errorf("unexpected panic error: %v", perr)
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected the panicking task's slot to be released, %d in use", n)
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	th := NewThrottler(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ran := false
+	err := th.Do(ctx, func() { ran = true })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if ran {
+		t.Error("expected no task to run after cancellation")
+	}
+}
+
+func TestDoCanceledMidBatch(t *testing.T) {
+	th := NewThrottler(1)
+	other := use(t, th)
+	ctx, cancel := context.WithCancel(context.Background())
+	started, finish := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- th.Do(ctx,
+			func() {
+				close(started)
+				<-finish
+			},
+			func() { t.Error("expected the second task to be skipped") },
+		)
+	}()
+	<-started
+	cancel()
+
+	// the running task keeps its slot until it finishes
+	time.Sleep(10 * time.Millisecond)
+	if err := th.TryNext(other); err != ErrWouldBlock {
+		t.Errorf("expected the running task to still hold its slot, got %v", err)
+	}
+	close(finish)
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected every slot to be released, %d in use", n)
+	}
+}
+
+func TestDoReport(t *testing.T) {
+	th := NewThrottler(1)
+	boom := errors.New("boom")
+	var ran int64
+	errs := th.DoReport(context.Background(),
+		func() error { atomic.AddInt64(&ran, 1); return nil },
+		func() error { atomic.AddInt64(&ran, 1); return boom },
+		func() error { atomic.AddInt64(&ran, 1); return nil },
+		func() error { atomic.AddInt64(&ran, 1); return nil },
+	)
+
+	// with one slot the tasks run in order, so the failure stops the rest from starting
+	if len(errs) != 4 || errs[0] != nil || errs[1] != boom || errs[2] != ErrNotRun || errs[3] != ErrNotRun {
+		t.Fatalf("expected [nil boom ErrNotRun ErrNotRun], got %v", errs)
+	}
+	if ran != 2 {
+		t.Errorf("expected 2 tasks to run, %d did", ran)
+	}
+	if s := th.String(); s != "WgThrottler{total: 0/1, users: 0, state: running}" {
+		t.Errorf("expected every slot and the batch's user to be released, got %s", s)
+	}
+}
+
+func TestDoReportBounded(t *testing.T) {
+	th := NewThrottler(2)
+	var running, peak int64
+	tasks := make([]func() error, 10)
+	for i := range tasks {
+		tasks[i] = func() error {
+			raisePeak(&peak, atomic.AddInt64(&running, 1))
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&running, -1)
+			return nil
+		}
+	}
+	tasks[4] = func() error { panic("boom") }
+
+	errs := th.DoReport(context.Background(), tasks...)
+	var perr *PanicError
+	if !errors.As(errs[4], &perr) || perr.Value != "boom" {
+		t.Fatalf("expected the panic to be reported in its task's entry, got %v", errs[4])
+	}
+	for i := 0; i < 4; i++ {
+		if errs[i] != nil {
+			t.Errorf("expected task %d to succeed, got %v", i, errs[i])
+		}
+	}
+	if peak > 2 {
+		t.Errorf("expected at most 2 concurrent tasks, saw %d", peak)
+	}
+}
+
+func TestDoReportCanceledMidBatch(t *testing.T) {
+	th := NewThrottler(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	started, finish := make(chan struct{}), make(chan struct{})
+	done := make(chan []error)
+	go func() {
+		done <- th.DoReport(ctx,
+			func() error {
+				close(started)
+				<-finish
+				return nil
+			},
+			func() error { return nil },
+		)
+	}()
+	<-started
+	cancel()
+
+	// the running task keeps its slot until it finishes
+	time.Sleep(10 * time.Millisecond)
+	if n := th.Len(); n != 1 {
+		t.Errorf("expected the running task to still hold its slot, %d in use", n)
+	}
+	close(finish)
+	if errs := <-done; errs[0] != nil || errs[1] != ErrNotRun {
+		t.Errorf("expected [nil ErrNotRun], got %v", errs)
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected every slot to be released, %d in use", n)
+	}
+}
+
+func TestDoReportCanceled(t *testing.T) {
+	th := NewThrottler(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs := th.DoReport(ctx, func() error { return nil }, func() error { return nil })
+	if len(errs) != 2 || errs[0] != ErrNotRun || errs[1] != ErrNotRun {
+		t.Errorf("expected every task to be reported as not run, got %v", errs)
+	}
+
+	th.Close()
+	errs = th.DoReport(context.Background(), func() error { return nil })
+	if len(errs) != 1 || errs[0] != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", errs)
+	}
+}
+
+// raisePeak records n as the new peak if it exceeds the current one.
+func raisePeak(peak *int64, n int64) {
+	for {
+		p := atomic.LoadInt64(peak)
+		if n <= p || atomic.CompareAndSwapInt64(peak, p, n) {
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package wgthrottler
+
+import (
+	"context"
+)
+
+// Future is the eventual result of a function passed to Submit.
+type Future struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// Await blocks until the submitted function has completed and returns its result.
+// Await may be called any number of times, from any goroutine, and always returns the same result.
+func (f *Future) Await() (any, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// Submit runs fn in its own goroutine on behalf of the user context, returning a Future for its result.
+// Like Next, Submit blocks until a slot is available before starting fn, and the slot is released as soon as fn returns.
+// If no slot could be acquired, the Future resolves immediately with the error from Next.
+// A panic in fn is recovered and reported by the Future as a *PanicError.
+//	f := wg.Submit(ctx, func() (any, error) {
+//	    return fetch("a")
+//	})
+//	...
+//	v, err := f.Await()
+func (wg *WgThrottler) Submit(ctx context.Context, fn func() (any, error)) *Future {
+	return wg.submit(ctx, "Submit", func(context.Context) (any, error) {
+		return fn()
+	})
+}
+
+// SubmitCtx is equivalent to Submit, but passes fn a context derived from ctx which carries the acquisition's id,
+// retrievable with AcquireID, as for Go.
+func (wg *WgThrottler) SubmitCtx(ctx context.Context, fn func(ctx context.Context) (any, error)) *Future {
+	return wg.submit(ctx, "SubmitCtx", fn)
+}
+
+// submit implements Submit and SubmitCtx.
+func (wg *WgThrottler) submit(ctx context.Context, method string, fn func(ctx context.Context) (any, error)) *Future {
+	f := &Future{done: make(chan struct{})}
+	user, err := wg.user(ctx, method)
+	var id int64
+	if err == nil {
+		id, err = wg.grant(ctx, Normal, user)
+	}
+	if err != nil {
+		f.err = err
+		close(f.done)
+		return f
+	}
+
+	task := context.WithValue(ctx, acquireKey{}, id)
+	start := wg.clock()
+	go func() {
+		defer close(f.done)
+		f.err = protect(func() (err error) {
+			f.value, err = fn(task)
+			return err
+		})
+		wg.DoneErr(ctx, wg.clock().Sub(start), f.err)
+	}()
+	return f
+}
+
+// Go runs fn in its own goroutine on behalf of the user context, like Next followed by a go statement, and returns the
+// slot to the pool as soon as fn returns. Like Next, Go blocks until a slot is available, returning its error if none
+// could be acquired, in which case fn is not run.
+// fn is passed a context derived from ctx which carries the acquisition's id, retrievable with AcquireID, for correlating
+// the task's logs with the acquisition as reported to an AcquireObserver.
+//	wg.Go(ctx, func(ctx context.Context) {
+//	    id, _ := wgthrottler.AcquireID(ctx)
+//	    log.Printf("acquisition %d: fetching", id)
+//	})
+func (wg *WgThrottler) Go(ctx context.Context, fn func(ctx context.Context)) error {
+	user, err := wg.user(ctx, "Go")
+	if err != nil {
+		return err
+	}
+	id, err := wg.grant(ctx, Normal, user)
+	if err != nil {
+		return err
+	}
+
+	task := context.WithValue(ctx, acquireKey{}, id)
+	start := wg.clock()
+	go func() {
+		defer func() {
+			wg.DoneErr(ctx, wg.clock().Sub(start), nil)
+		}()
+		fn(task)
+	}()
+	return nil
+}
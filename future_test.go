@@ -0,0 +1,135 @@
+package wgthrottler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubmit(t *testing.T) {
+	th := NewThrottler(2)
+	user := use(t, th)
+
+	futures := make([]*Future, 5)
+	for i := range futures {
+		i := i
+		futures[i] = th.Submit(user, func() (any, error) {
+			return i * i, nil
+		})
+	}
+	for i, f := range futures {
+		for j := 0; j < 2; j++ {
+			v, err := f.Await()
+			if err != nil || v != i*i {
+				t.Errorf("future %d: expected %d, got %v (%v)", i, i*i, v, err)
+			}
+		}
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected every slot to be released, %d in use", n)
+	}
+}
+
+func TestSubmitErrors(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+
+	boom := errors.New("boom")
+	if _, err := th.Submit(user, func() (any, error) { return nil, boom }).Await(); err != boom {
+		t.Errorf("expected the function's error, got %v", err)
+	}
+
+	var perr *PanicError
+	if _, err := th.Submit(user, func() (any, error) { panic("boom") }).Await(); !errors.As(err, &perr) {
+		t.Errorf("expected a *PanicError, got %v", err)
+	}
+
+	th.Close()
+	if _, err := th.Submit(user, func() (any, error) { return nil, nil }).Await(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+// observingMetrics records the acquisition ids reported to an AcquireObserver.
+type observingMetrics struct {
+	spyMetrics
+	ids []int64
+}
+
+func (o *observingMetrics) ObserveAcquire(id int64, _ time.Duration) { o.ids = append(o.ids, id) }
+
+func TestGo(t *testing.T) {
+	metrics := &observingMetrics{}
+	th := NewThrottler(2, WithMetrics(metrics))
+	user := use(t, th)
+
+	var mu sync.Mutex
+	ids := make(map[int64]bool)
+	for i := 0; i < 5; i++ {
+		if err := th.Go(user, func(ctx context.Context) {
+			id, ok := AcquireID(ctx)
+			if !ok {
+				t.Error("expected the task's context to carry an acquisition id")
+			}
+			if u, _ := UserID(ctx); u != 1 {
+				t.Errorf("expected the task's context to carry the user, got %d", u)
+			}
+			mu.Lock()
+			ids[id] = true
+			mu.Unlock()
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	th.Wait()
+
+	th.Lock()
+	defer th.Unlock()
+	if len(ids) != 5 || len(metrics.ids) != 5 {
+		t.Fatalf("expected 5 distinct ids, got %v from the tasks and %v from the metrics", ids, metrics.ids)
+	}
+	for i, id := range metrics.ids {
+		if !ids[id] {
+			t.Errorf("observed id %d was not seen by any task", id)
+		}
+		if i > 0 && id <= metrics.ids[i-1] {
+			t.Errorf("expected increasing ids, got %v", metrics.ids)
+		}
+	}
+	if _, ok := AcquireID(user); ok {
+		t.Error("expected no acquisition id on the user context itself")
+	}
+}
+
+func TestSubmitCtx(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	first, err := th.SubmitCtx(user, func(ctx context.Context) (any, error) {
+		id, ok := AcquireID(ctx)
+		if !ok {
+			return nil, errors.New("no acquisition id")
+		}
+		return id, nil
+	}).Await()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := th.SubmitCtx(user, func(ctx context.Context) (any, error) {
+		id, _ := AcquireID(ctx)
+		return id, nil
+	}).Await()
+	if first.(int64) >= second.(int64) {
+		t.Errorf("expected increasing acquisition ids, got %v then %v", first, second)
+	}
+}
+
+func TestGoClosed(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	th.Close()
+	if err := th.Go(user, func(context.Context) { t.Error("expected fn not to run") }); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package wgthrottler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// spyMetrics counts the calls made to each Metrics hook.
+type spyMetrics struct {
+	acquired, released, waits int
+	waited                    time.Duration
+	inflight                  []int
+}
+
+func (s *spyMetrics) IncAcquired()                { s.acquired++ }
+func (s *spyMetrics) IncReleased()                { s.released++ }
+func (s *spyMetrics) ObserveWait(d time.Duration) { s.waits++; s.waited += d }
+func (s *spyMetrics) SetInflight(n int)           { s.inflight = append(s.inflight, n) }
+
+func TestMetrics(t *testing.T) {
+	spy := &spyMetrics{}
+	th := NewThrottler(1, WithMetrics(spy))
+	clock := useFakeClock(th)
+	user := use(t, th)
+
+	th.Next(user)
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+	clock.Advance(5 * time.Millisecond)
+	th.Done(user)
+	<-acquired
+	th.Done(user)
+
+	th.Lock()
+	defer th.Unlock()
+	if spy.acquired != 2 || spy.released != 2 || spy.waits != 2 {
+		t.Errorf("expected 2 of each, got %d acquired, %d released and %d waits", spy.acquired, spy.released, spy.waits)
+	}
+	if spy.waited != 5*time.Millisecond {
+		t.Errorf("expected 5ms waited in total, got %v", spy.waited)
+	}
+	if got := len(spy.inflight); got != 4 || spy.inflight[0] != 1 || spy.inflight[3] != 0 {
+		t.Errorf("expected the in-flight count set on every change, got %v", spy.inflight)
+	}
+}
+
+var expvarRuns int
+
+func TestExpvarMetrics(t *testing.T) {
+	// expvar names can't be reused, even across repeated runs of the test
+	expvarRuns++
+	m := NewExpvarMetrics(fmt.Sprintf("wgthrottler_test_%d", expvarRuns))
+	th := NewThrottler(2, WithMetrics(m))
+	user := use(t, th)
+	th.Next(user)
+	th.Next(user)
+	th.Done(user)
+
+	if m.Acquired.Value() != 2 || m.Released.Value() != 1 || m.Waits.Value() != 2 || m.Inflight.Value() != 1 {
+		t.Errorf("unexpected metrics acquired=%v released=%v waits=%v inflight=%v", m.Acquired, m.Released, m.Waits, m.Inflight)
+	}
+}
@@ -0,0 +1,73 @@
+package wgthrottler
+
+import (
+	"context"
+	"sync"
+)
+
+// Quota composes several throttlers into hierarchical limits, such as a global cap across a whole service
+// with a sub-cap per region, where every task must hold a slot from each of them.
+//  throttlers - Throttlers to acquire from, outermost first
+//  users - The quota's user context on each of the throttlers
+type Quota struct {
+	throttlers []*WgThrottler
+	users      []context.Context
+}
+
+// NewQuota returns a Quota acquiring from each of the throttlers in the given order, outermost first,
+// registering a user of its own with each of them. If any registration fails, those already made are
+// released again and the error is returned.
+// Slots are always acquired in the same order, so quotas sharing throttlers cannot deadlock against each other
+// as long as every one of them lists the shared throttlers in the same relative order.
+//	global := wgthrottler.NewThrottler(100)
+//	eu, err := wgthrottler.NewQuota(global, wgthrottler.NewThrottler(20))
+func NewQuota(throttlers ...*WgThrottler) (*Quota, error) {
+	q := &Quota{
+		throttlers: throttlers,
+		users:      make([]context.Context, 0, len(throttlers)),
+	}
+	for _, wg := range throttlers {
+		user, err := wg.Use()
+		if err != nil {
+			q.Close()
+			return nil, err
+		}
+		q.users = append(q.users, user)
+	}
+	return q, nil
+}
+
+// Acquire blocks until a slot has been granted by every throttler of the quota, in order.
+// On success the returned release function returns the slots in reverse order; calling it more than once has no
+// further effect. If acquisition from any throttler fails, or ctx is canceled, the slots already acquired from the
+// outer throttlers are returned before the error is.
+func (q *Quota) Acquire(ctx context.Context) (release func(), err error) {
+	held := 0
+	undo := func() {
+		for i := held - 1; i >= 0; i-- {
+			q.throttlers[i].Done(q.users[i])
+		}
+	}
+	for i, wg := range q.throttlers {
+		user, _ := q.users[i].Value(userKey{}).(int)
+		if err = wg.next(ctx, Normal, user); err != nil {
+			undo()
+			return nil, err
+		}
+		held++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(undo)
+	}, nil
+}
+
+// Close unregisters the quota's users from each of its throttlers, as for ReleaseUser.
+// Slots still held may be returned with their release functions as usual.
+func (q *Quota) Close() error {
+	for i, user := range q.users {
+		q.throttlers[i].ReleaseUser(user)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package wgthrottler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	global := NewThrottler(2)
+	region := NewThrottler(1)
+	q, err := NewQuota(global, region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := q.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global.Len() != 1 || region.Len() != 1 {
+		t.Fatalf("expected a slot from each throttler, got %v and %v", global, region)
+	}
+
+	// the region is full, so the global slot taken on the way in must be handed back
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the region to block, got %v", err)
+	}
+	if n := global.Len(); n != 1 {
+		t.Errorf("expected the outer slot to be released on failure, %d in use", n)
+	}
+
+	release()
+	release()
+	if global.Len() != 0 || region.Len() != 0 {
+		t.Errorf("expected release to return every slot exactly once, got %v and %v", global, region)
+	}
+
+	q.Close()
+	if _, err := q.Acquire(context.Background()); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser after Close, got %v", err)
+	}
+}
+
+func TestQuotaRegistrationFails(t *testing.T) {
+	global := NewThrottler(2)
+	full := NewThrottler(2, WithMaxUsers(1))
+	use(t, full)
+	if _, err := NewQuota(global, full); err != ErrNoUserSlots {
+		t.Fatalf("expected ErrNoUserSlots, got %v", err)
+	}
+	if s := global.String(); s != "WgThrottler{total: 0/2, users: 0, state: running}" {
+		t.Errorf("expected the registration to be rolled back, got %s", s)
+	}
+}
@@ -0,0 +1,75 @@
+package wgthrottler
+
+import (
+	"sync"
+)
+
+// SimpleThrottler - A throttled waitgroup for the common case of running at most max processes at a time.
+// Unlike WgThrottler it has no notion of users or fair shares, so there is no Use() step and Next() is never
+// held back by anything other than the global limit.
+//  c - Count of processes currently holding a slot
+//  sem - Buffered channel holding one token per slot in use
+//  idle - Condition broadcast when c drops to 0
+type SimpleThrottler struct {
+	sync.Mutex
+	c    int
+	sem  chan struct{}
+	idle *sync.Cond
+}
+
+// NewSimpleThrottler will return a new SimpleThrottler with the desired
+// maximum concurrency limit 'max'.
+func NewSimpleThrottler(max int) *SimpleThrottler {
+	wg := &SimpleThrottler{
+		sem: make(chan struct{}, max),
+	}
+	wg.idle = sync.NewCond(&wg.Mutex)
+	return wg
+}
+
+// Next will block until fewer than max processes hold a slot, then allocate one.
+//	for i := 0; i < 10; i++ {
+//	    wg.Next()
+//	    go func() {
+//	        defer wg.Done()
+//	        MyFunc()
+//	    }()
+//	}
+//	wg.Wait()
+func (wg *SimpleThrottler) Next() {
+	wg.sem <- struct{}{}
+	wg.Lock()
+	defer wg.Unlock()
+	wg.c++
+}
+
+// Done returns a slot allocated by Next to the pool. Calling Done without a matching Next has no effect.
+func (wg *SimpleThrottler) Done() {
+	wg.Lock()
+	defer wg.Unlock()
+	if wg.c <= 0 {
+		return
+	}
+	wg.c--
+	<-wg.sem
+	if wg.c == 0 {
+		wg.idle.Broadcast()
+	}
+}
+
+// Wait is functionally equivalent to a regular sync.WaitGroup's Wait() method.
+// It blocks until every slot allocated by Next has been returned with Done.
+func (wg *SimpleThrottler) Wait() {
+	wg.Lock()
+	defer wg.Unlock()
+	for wg.c > 0 {
+		wg.idle.Wait()
+	}
+}
+
+// Len returns the number of processes currently holding a slot.
+func (wg *SimpleThrottler) Len() int {
+	wg.Lock()
+	defer wg.Unlock()
+	return wg.c
+}
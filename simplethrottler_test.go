@@ -0,0 +1,37 @@
+package wgthrottler
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSimpleThrottler(t *testing.T) {
+	th := NewSimpleThrottler(3)
+	var running, peak, ran int64
+	for i := 0; i < 20; i++ {
+		th.Next()
+		go func() {
+			defer th.Done()
+			raisePeak(&peak, atomic.AddInt64(&running, 1))
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&running, -1)
+			atomic.AddInt64(&ran, 1)
+		}()
+	}
+	th.Wait()
+
+	if n := atomic.LoadInt64(&ran); n != 20 {
+		t.Errorf("expected Wait to return after all 20 tasks, %d ran", n)
+	}
+	if p := atomic.LoadInt64(&peak); p > 3 {
+		t.Errorf("expected at most 3 concurrent tasks, saw %d", p)
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected every slot to be returned, %d in use", n)
+	}
+
+	// an unmatched Done must not block or underflow
+	th.Done()
+	th.Wait()
+}
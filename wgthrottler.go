@@ -2,7 +2,11 @@ package wgthrottler
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 )
 
 // Throttler is an interface which expects three methods: Done(), Wait(), and Next().
@@ -12,10 +16,122 @@ import (
 // This context should be used as the input to Done() and Next() to prevent the case of a deadlock
 // whereby one 'user' of the Throttler manages to hoard all capacity in a blocking procedure
 type Throttler interface {
-	Done(ctx context.Context)
+	Done(ctx context.Context) error
 	Wait()
-	Next(ctx context.Context)
-	Use() context.Context
+	Next(ctx context.Context) error
+	Use() (context.Context, error)
+}
+
+// ErrUnknownUser is returned when a user context refers to a user which is not registered with the throttler.
+var ErrUnknownUser = errors.New("wgthrottler: unknown user")
+
+// ErrAcquireTimeout is returned when a slot could not be acquired within the allotted time.
+var ErrAcquireTimeout = errors.New("wgthrottler: timed out waiting for a slot")
+
+// ErrClosed is returned when the throttler has been closed.
+var ErrClosed = errors.New("wgthrottler: throttler closed")
+
+// ErrForeignContext is returned when a user context acquired from one throttler is passed to another.
+var ErrForeignContext = errors.New("wgthrottler: context belongs to a different throttler")
+
+// ErrNoUserSlots is returned when the throttler already has as many users as allowed by WithMaxUsers.
+var ErrNoUserSlots = errors.New("wgthrottler: no user slots available")
+
+// ErrExceedsMax is returned when a single request asks for more slots than the throttler could ever grant at once,
+// either in total or to one of the users it is made for.
+var ErrExceedsMax = errors.New("wgthrottler: request exceeds max concurrency")
+
+// ErrInvalidLimit is returned when a per-user limit is not between 1 and the throttler's max.
+var ErrInvalidLimit = errors.New("wgthrottler: limit must be between 1 and max")
+
+// ErrNotInitialized is returned when a WgThrottler was not created with NewThrottler and so has no capacity to hand out.
+var ErrNotInitialized = errors.New("wgthrottler: throttler must be created with NewThrottler")
+
+// ErrInvalidMax is returned when a max is less than 1, or too small for the reservations made via WithReservation.
+var ErrInvalidMax = errors.New("wgthrottler: invalid max")
+
+// ErrUserDraining is returned when a slot is requested for a user which is being drained via DrainUser.
+var ErrUserDraining = errors.New("wgthrottler: user is draining")
+
+// ErrWouldBlock is returned by TryNext when no slot can be granted without waiting.
+var ErrWouldBlock = errors.New("wgthrottler: no slot available")
+
+// ErrInvalidWeight is returned when a weight passed to NextN, DoneN or Downgrade is out of range.
+var ErrInvalidWeight = errors.New("wgthrottler: invalid weight")
+
+// ErrUpgrade is returned when Downgrade is asked to raise the weight held by a user, which must go through NextN.
+var ErrUpgrade = errors.New("wgthrottler: cannot downgrade to a higher weight")
+
+// ErrDraining is returned when a slot or user is requested from a throttler which is being drained via Drain.
+var ErrDraining = errors.New("wgthrottler: throttler draining")
+
+// ErrInvalidTransition is returned when the throttler cannot move from its current State to the one requested.
+var ErrInvalidTransition = errors.New("wgthrottler: invalid state transition")
+
+// ErrNotRun is reported by DoReport in place of a task which was never started because the batch was canceled first.
+var ErrNotRun = errors.New("wgthrottler: task not run")
+
+// Priority selects the lane a call to NextPriority waits in.
+// Waiters in the High lane are granted freed slots before any waiter in the Normal lane.
+type Priority int
+
+const (
+	// Normal is the lane used by Next.
+	Normal Priority = iota
+	// High is the lane for latency-sensitive work which should jump ahead of queued Normal waiters.
+	High
+)
+
+// Rounding selects how the pool is divided between users when max is not a multiple of their number, as set via WithRounding.
+type Rounding int
+
+const (
+	// Ceil rounds each user's share up, the default. No slot is ever left idle for want of a user entitled to it, but the
+	// shares add up to more than max, so a user may momentarily hold more than its fair portion while others wait.
+	Ceil Rounding = iota
+	// Floor rounds each user's share down, though never below one slot. The shares never add up to more than max,
+	// but up to one slot fewer than there are users may be left idle even though work is queued for it.
+	Floor
+	// Strict rounds each user's share down, then hands out the remaining slots one each to whichever users take them
+	// first, judged against the slots held right now, so that the shares add up to exactly max: none is left idle and
+	// no user holds more than its fair portion. Each share is computed across every user, so it costs O(users).
+	Strict
+)
+
+// State is the stage of its lifecycle a throttler is in, as reported by State.
+// A throttler starts out Running and may move between Running and Paused any number of times,
+// then on to Draining and Closed, or straight to Closed, from which there is no way back.
+type State int
+
+const (
+	// Running is the state in which slots are granted as usual.
+	Running State = iota
+	// Paused is the state entered by Pause, in which calls to Next queue up but no slots are granted.
+	Paused
+	// Draining is the state entered by Drain, in which no further slots are granted while held slots are returned.
+	Draining
+	// Closed is the state entered by Close, or once Drain has completed.
+	Closed
+)
+
+// String returns the name of the state in lower case, e.g. "running".
+func (s State) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Paused:
+		return "paused"
+	case Draining:
+		return "draining"
+	case Closed:
+		return "closed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// MarshalText encodes the state by name, so that it reads naturally in the JSON encoding of Stats.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
 }
 
 // WgThrottler - A throttled waitgroup for limiting concurrent/parallel processes.
@@ -23,123 +139,2107 @@ type Throttler interface {
 //  last - Auto-incrementing integer to use as identifiers for users
 //  total - Total utilized concurrency
 //  max - Maximum allowed number of active processes
-//  ch - Channel used to communicate when a process is complete
+//  maxUsers - Maximum allowed number of registered users, 0 for no limit
+//  softCap - Number of live users above which a warning is logged, 0 for no warning
+//  undivided - Let any user take the whole pool rather than dividing it between the users
+//  rounding - How each user's share of the pool is rounded when max is not a multiple of the number of users
+//  fixedShare - Divide the pool between every registered user rather than only those with pending work
+//  constructed - Set by NewThrottler, to tell a throttler created with too small a max from a zero value
+//  setup - Guards the lazy initialization of the maps and cond, so that a zero value is safe to use
+//  cond - Condition broadcast whenever a process is complete or a slot is granted
+//  completed - Number of processes completed since the last Reset
+//  peaks - Most slots held at once by each user since the last Reset
+//  grants - Number of slots granted, used to order the turns of users
+//  turns - Value of grants as of each user's most recent grant, used to take turns when there are more active users than slots
+//  waiters - Goroutines currently blocked in Next, in arrival order
+//  wMap - Count of goroutines blocked in Next on behalf of each user
+//  lanes - Count of goroutines blocked in Next in each priority lane
+//  active - Number of users holding or waiting for at least one slot
+//  reservation - Slots guaranteed to each active user which others may not consume, set via WithReservation
+//  caps - Explicit ceilings on the slots held by individual users, set via UserSetMax
+//  leaving - Users released via ReleaseUser which are purged once their last slot is returned
+//  fallback - Context of the default user used by Acquire and Release, nil until first needed
+//  labels - Human-readable labels of the users registered via UseLabeled
+//  draining - Users being drained via DrainUser, which may not be granted any further slots
+//  stops - Unregisters the release of each user on cancellation of its context, for users created via UseFrom
+//  timeout - Longest a call to Next may wait for a slot when its context has no deadline, 0 for no limit
+//  normalReserve - Consecutive High grants allowed while Normal work is queued, 0 for no limit
+//  highStreak - Consecutive High grants made while Normal work was queued
+//  wfq - Grant slots to the user with the least service per unit of weight first, within a priority lane
+//  service - Total time the slots of each user have been held, tracked only for WithWFQ; raised to that of the other
+//    active users whenever a user becomes active
+//  weights - Weights of the users set via UserSetWeight, 1 for any other
+//  edf - Grant slots to the waiter with the earliest deadline first, within a priority lane
+//  latency - Acquisition latency recorder, nil unless enabled via WithLatencyStats
+//  saturated - Whether the pool was fully allocated as of the last recorded transition
+//  freeAt - Last time the pool had free capacity, recorded whenever it becomes fully allocated, for Healthy
+//  edges - Number of transitions between saturated and having free capacity
+//  notifier - Delivers transitions to the OnSaturated/OnIdle callbacks, nil if neither is set
+//  metrics - Receives the throttler's metrics, NopMetrics unless set via WithMetrics
+//  adaptive - Controller deciding max from the outcome of each task, nil unless set via WithAdaptive
+//  started - Grant times of the slots held by each user, oldest first, tracked only for WithWFQ
+//  quiet - Channels returned by WaitChan, closed once no slots are held or waited for
+//  ready - Signaled whenever a slot is returned while the pool has free capacity, nil until requested via Ready
+//  paused - Set by Pause and cleared by Resume; no slots are granted while it is set
+//  stopping - Set by Drain, after which no further users or slots are handed out while held slots are returned
+//  closed - Set by Close, after which no further users or slots are handed out
+//  now - Clock used for all timing, replaced by tests; time.Now when nil
+//  parent - Throttler this one was carved from via Sub, nil otherwise
+//  parentUser - User context under which slots of the parent are held on behalf of this throttler
+//  lent - Number of this throttler's slots backed by a slot of the parent
+//  owed - Number of parent slots to hand back once the lock is released
+//  violated - Called whenever a grant leaves more than max slots held, nil unless set via WithInvariantCheck
+//  onGrant - Test hook invoked with the lock held whenever a slot is granted, nil in normal use
 type WgThrottler struct {
 	sync.Mutex
-	cMap  map[int]int
-	last  int
-	total int
-	max   int
-	ch    chan struct{}
+	cMap          map[int]int
+	last          int
+	total         int
+	max           int
+	maxUsers      int
+	softCap       int
+	undivided     bool
+	rounding      Rounding
+	fixedShare    bool
+	constructed   bool
+	setup         sync.Once
+	cond          *sync.Cond
+	completed     int64
+	peaks         map[int]int
+	grants        uint64
+	turns         map[int]uint64
+	waiters       []*waiter
+	wMap          map[int]int
+	lanes         [High + 1]int
+	active        int
+	reservation   int
+	caps          map[int]int
+	leaving       map[int]bool
+	fallback      context.Context
+	labels        map[int]string
+	draining      map[int]bool
+	stops         map[int]func() bool
+	timeout       time.Duration
+	normalReserve int
+	highStreak    int
+	wfq           bool
+	service       map[int]time.Duration
+	weights       map[int]int
+	edf           bool
+	latency       *latencyRecorder
+	saturated     bool
+	freeAt        time.Time
+	edges         uint64
+	notifier      *edgeNotifier
+	metrics       Metrics
+	adaptive      AdaptiveController
+	started       map[int][]time.Time
+	quiet         []chan struct{}
+	ready         chan struct{}
+	paused        bool
+	stopping      bool
+	closed        bool
+	now           func() time.Time
+	parent        *WgThrottler
+	parentUser    context.Context
+	lent          int
+	owed          int
+	violated      func(total, max int)
+	onGrant       func(user int)
+}
+
+// waiter is a goroutine blocked in Next on behalf of a user.
+// The waiters queued together by NextN or AcquireMulti share a group, which can only be granted as a whole.
+type waiter struct {
+	user      int
+	prio      Priority
+	reentrant bool
+	deadline  time.Time
+	group     []*waiter
+}
+
+type reentrantKey struct{}
+
+// Reentrant returns a copy of the user context for a task which already holds a slot and must acquire more on
+// behalf of the same user, as in recursive work. While the user holds at least one slot, calls to Next with the returned
+// context are bound only by the global max and not by the user's share, since waiting on the user's own outstanding
+// slots would deadlock. A user holding no slots is bound by its share as usual, so the marker can't be used to take
+// more than a fair portion of the pool from the top level. Slots acquired this way are released with Done as usual,
+// using either context.
+func Reentrant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reentrantKey{}, true)
+}
+
+// Option configures optional behavior of a WgThrottler at construction time.
+type Option func(wg *WgThrottler)
+
+// WithLatencyStats enables recording of how long each call to Next blocks before a slot is granted.
+// The recorded values are available via LatencyStats(). Throttlers created without this option pay no recording cost.
+func WithLatencyStats() Option {
+	return func(wg *WgThrottler) {
+		wg.latency = &latencyRecorder{}
+	}
+}
+
+// WithMaxUsers bounds the number of users which may be registered via Use() at once.
+// This is independent of the concurrency limit; by default any number of users may share the pool.
+func WithMaxUsers(n int) Option {
+	return func(wg *WgThrottler) {
+		wg.maxUsers = n
+	}
+}
+
+// WithInvariantCheck verifies after every grant that no more than max slots are held, calling violated with the total
+// and max if ever they are, e.g. to log, panic or count the violation. It is a safety net for the fair-share rules,
+// and is called with the throttler locked, so it must not call back into it.
+func WithInvariantCheck(violated func(total, max int)) Option {
+	return func(wg *WgThrottler) {
+		wg.violated = violated
+	}
+}
+
+// WithUserSoftCap logs a warning whenever the number of live users rises above n, which in a long-running program
+// usually means user contexts are leaking rather than being released. Unlike WithMaxUsers, no user is ever refused.
+// See also UsersCreated and UserCount.
+func WithUserSoftCap(n int) Option {
+	return func(wg *WgThrottler) {
+		wg.softCap = n
+	}
+}
+
+// OnSaturated registers fn to be called whenever the pool becomes fully allocated.
+// It is called only on the transition from having free capacity, never while the throttler's lock is held,
+// so fn may safely call back into the throttler. See OnIdle for the opposite transition.
+func OnSaturated(fn func()) Option {
+	return func(wg *WgThrottler) {
+		if wg.notifier == nil {
+			wg.notifier = &edgeNotifier{}
+		}
+		wg.notifier.onSaturated = fn
+	}
+}
+
+// OnIdle registers fn to be called whenever a fully allocated pool regains free capacity.
+// Like OnSaturated, it fires only on the transition and outside of the throttler's lock.
+// Rapid churn at the boundary is collapsed, so callbacks always alternate and reflect the latest state.
+func OnIdle(fn func()) Option {
+	return func(wg *WgThrottler) {
+		if wg.notifier == nil {
+			wg.notifier = &edgeNotifier{}
+		}
+		wg.notifier.onIdle = fn
+	}
+}
+
+// WithReservation guarantees each active user a floor of 'per' slots which no other user can consume.
+// Slots are held back from the shared pool for every user which holds or waits for fewer than its reservation,
+// and the remaining slots are allocated first-come as usual, so a busy user can never starve a newly active one.
+// Since every user must be able to hold its reservation at once, WithMaxUsers is required and per * maxUsers
+// may not exceed max; NewThrottler panics otherwise.
+func WithReservation(per int) Option {
+	return func(wg *WgThrottler) {
+		wg.reservation = per
+	}
+}
+
+// WithNoFairDivision turns off the division of the pool between users, so that Next is gated only by the global max,
+// as for a plain shared semaphore, while users are still tracked for Stats and the like. This is an escape hatch for
+// deployments which would rather have a busy user's calls to TryNext fail with ErrWouldBlock once the pool is full
+// than see its concurrency quietly divided down as more users register. Ceilings set via UserSetMax still apply.
+func WithNoFairDivision() Option {
+	return func(wg *WgThrottler) {
+		wg.undivided = true
+	}
+}
+
+// WithRounding sets how each user's share of the pool is rounded when max does not divide evenly between the users.
+// The default is Ceil; see Rounding for the tradeoffs. The global max is never exceeded whichever is chosen.
+func WithRounding(r Rounding) Option {
+	return func(wg *WgThrottler) {
+		wg.rounding = r
+	}
+}
+
+// WithNormalReserve prevents High priority work from starving Normal work entirely.
+// Once 'every' consecutive slots have gone to High waiters while Normal waiters were queued,
+// the next freed slot is reserved for a Normal waiter, guaranteeing Normal work roughly 1/(every+1) of the grants under contention.
+func WithNormalReserve(every int) Option {
+	return func(wg *WgThrottler) {
+		wg.normalReserve = every
+	}
+}
+
+// WithAdaptive lets the controller tune max as work completes: each returned slot reports how long its task ran and the
+// error it finished with, and the max returned by the controller is applied as for SetMax. Go, Submit, Do and DoReport
+// time each of their tasks exactly; tasks run with Next should return their slots with DoneErr, since a plain Done
+// reports no duration and no error. The controller is called with the throttler locked, so it must not call back into it.
+func WithAdaptive(controller AdaptiveController) Option {
+	return func(wg *WgThrottler) {
+		wg.adaptive = controller
+	}
+}
+
+// WithWFQ enables weighted fair queueing: among goroutines blocked in Next within the same priority lane, the next freed
+// slot goes to the user which has received the least service so far, measured as the total time its slots were held
+// divided by its weight, so that over time each user's throughput is proportional to its weight rather than only its
+// concurrency being bounded. A user which becomes active, having joined late or been idle, starts out level with the
+// least served of the users already active rather than with its lifetime total, so it can't monopolize the pool while
+// catching up. Weights are 1 unless set via UserSetWeight. With WithEDF, deadlines are considered first.
+func WithWFQ() Option {
+	return func(wg *WgThrottler) {
+		wg.wfq = true
+		wg.started = make(map[int][]time.Time)
+	}
+}
+
+// WithEDF enables earliest-deadline-first scheduling: among goroutines blocked in Next within the same priority lane,
+// the one whose context has the nearest deadline is granted the next freed slot. Waiters without a deadline go last.
+func WithEDF() Option {
+	return func(wg *WgThrottler) {
+		wg.edf = true
+	}
+}
+
+// WithAcquireTimeout bounds how long any call to Next, NextN, Acquire and the like may wait for a slot, for services
+// with a blanket policy never to block a worker for longer than d. ErrAcquireTimeout is returned if no slot was granted
+// within d. Calls whose context carries a deadline of its own wait until that deadline instead, whether it is sooner or later.
+func WithAcquireTimeout(d time.Duration) Option {
+	return func(wg *WgThrottler) {
+		wg.timeout = d
+	}
 }
 
 // NewThrottler will return a new WgThrottler with the desired
-// maximum concurrency limit 'max'.
-func NewThrottler(max int) *WgThrottler {
-	return &WgThrottler{
-		ch:    make(chan struct{}),
-		max:   max,
-		total: 0,
-		last:  0,
-		cMap:  make(map[int]int),
+// maximum concurrency limit 'max', configured by any given options.
+func NewThrottler(max int, opts ...Option) *WgThrottler {
+	wg := &WgThrottler{
+		max:         max,
+		total:       0,
+		last:        0,
+		constructed: true,
 	}
+	wg.setup.Do(wg.init)
+	for _, opt := range opts {
+		opt(wg)
+	}
+	if wg.reservation > 0 && (wg.maxUsers <= 0 || wg.reservation*wg.maxUsers > wg.max) {
+		panic("wgthrottler.WithReservation() requires WithMaxUsers, with reservations for every user fitting within max")
+	}
+	return wg
+}
+
+// init allocates the throttler's maps and cond.
+func (wg *WgThrottler) init() {
+	wg.cMap = make(map[int]int)
+	wg.wMap = make(map[int]int)
+	wg.caps = make(map[int]int)
+	wg.leaving = make(map[int]bool)
+	wg.labels = make(map[int]string)
+	wg.draining = make(map[int]bool)
+	wg.stops = make(map[int]func() bool)
+	wg.peaks = make(map[int]int)
+	wg.turns = make(map[int]uint64)
+	wg.service = make(map[int]time.Duration)
+	wg.weights = make(map[int]int)
+	wg.cond = sync.NewCond(&wg.Mutex)
+	wg.metrics = NopMetrics{}
+}
+
+// Lock locks the throttler, first initializing it if it was not created with NewThrottler.
+// Every method takes the lock before touching any state, so a zero-value WgThrottler never panics on a nil map or cond;
+// having no capacity, it refuses new users with ErrNotInitialized instead.
+func (wg *WgThrottler) Lock() {
+	wg.setup.Do(wg.init)
+	wg.Mutex.Lock()
+}
+
+// Sub carves a child throttler out of wg which may hold at most k of its slots, so that a particular subsystem
+// can't monopolize the pool. The child is used like any other throttler, with users of its own between which its k
+// slots are shared fairly. Every slot granted by the child also holds a slot of wg, acquired under a single user of wg
+// registered for the child, and returning the child's slot returns both. Closing the child releases that user.
+// Sub panics if k is less than 1, or if the child's user cannot be registered with wg.
+func (wg *WgThrottler) Sub(k int) *WgThrottler {
+	if k < 1 {
+		panic("wg.Sub() called with k < 1")
+	}
+	user, err := wg.Use()
+	if err != nil {
+		panic("wg.Sub() cannot register a user for the child: " + err.Error())
+	}
+	child := NewThrottler(k)
+	child.parent = wg
+	child.parentUser = user
+	return child
+}
+
+// NewThrottlerWithUsers returns a new WgThrottler along with numUsers ready-to-use user contexts.
+// Since the set of users is known up front, the pool is always divided evenly between all of them,
+// rather than the first user briefly having the whole pool to itself before the others become active.
+func NewThrottlerWithUsers(max, numUsers int, opts ...Option) (*WgThrottler, []context.Context) {
+	wg := NewThrottler(max, opts...)
+	wg.fixedShare = true
+	users := make([]context.Context, numUsers)
+	for i := range users {
+		user, err := wg.Use()
+		if err != nil {
+			panic("wgthrottler.NewThrottlerWithUsers() cannot register " + fmt.Sprint(numUsers) + " users: " + err.Error())
+		}
+		users[i] = user
+	}
+	return wg, users
 }
 
 // Done is functionally equivalent to a sync.WaitGroup's Done() method.
-// An empty struct will be sent through ch and the underlying sync.WaitGroup
-func (wg *WgThrottler) Done(ctx context.Context) {
+// The user's concurrency is returned to the pool and any goroutines blocked in Next() or Wait() are woken.
+// Done never panics and is always safe to defer: once the throttler is closed, or if the user holds no slots,
+// it quietly does nothing beyond returning what is still held. ErrForeignContext or ErrUnknownUser is returned,
+// and nothing released, if the context was acquired from a different throttler or isn't a user context at all.
+func (wg *WgThrottler) Done(ctx context.Context) error {
+	return wg.done(ctx, 0, nil, "Done")
+}
+
+// DoneErr is equivalent to Done, but also reports how long the task ran and the error it finished with, if any,
+// to the AdaptiveController set via WithAdaptive. Only the caller knows which of a user's tasks is finishing,
+// so the duration must be measured by the caller from when the task's slot was granted:
+//	start := time.Now()
+//	err := work()
+//	wg.DoneErr(ctx, time.Since(start), err)
+func (wg *WgThrottler) DoneErr(ctx context.Context, took time.Duration, err error) error {
+	return wg.done(ctx, took, err, "DoneErr")
+}
+
+// done returns one of the user's slots to the pool, reporting the duration and outcome of the task which held it,
+// with a duration of 0 if it is unknown.
+func (wg *WgThrottler) done(ctx context.Context, took time.Duration, outcome error, method string) error {
+	if ctx == nil {
+		return ErrUnknownUser
+	}
+	if _, ok := ctx.Value(userKey{}).(int); !ok {
+		return ErrUnknownUser
+	}
 	// get user from context
-	u, ok := ctx.Value("user").(int)
-	if !ok {
-		panic("wg.Next() called with invalid user context. Context must be acquired via a respective call to wg.Use()")
+	u, err := wg.user(ctx, method)
+	if err != nil {
+		return err
 	}
 
+	wg.Lock()
+	// a late or unmatched Done must not drive the counts negative
+	if wg.cMap[u] <= 0 {
+		_, known := wg.cMap[u]
+		closed := wg.closed
+		wg.Unlock()
+		// a user released by the cancellation of its context has already had its slots returned
+		if !known && !closed && ctx.Err() == nil {
+			return ErrUnknownUser
+		}
+		return nil
+	}
 	// release concurrency from the user back to the pool
 	wg.dec(u)
+	wg.completed++
+	if wg.adaptive != nil && !wg.closed {
+		wg.setMax(wg.adaptive.Adjust(wg.max, took, outcome))
+	}
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
+	return nil
+}
+
+// DoneN returns n of the user's slots to the pool at once, as acquired by NextN.
+// ErrInvalidWeight is returned if n is less than 1. As with Done, no more than the user currently holds is released.
+func (wg *WgThrottler) DoneN(ctx context.Context, n int) error {
+	if n < 1 {
+		return ErrInvalidWeight
+	}
+	u, err := wg.user(ctx, "DoneN")
+	if err != nil {
+		return err
+	}
+
+	wg.Lock()
+	if _, ok := wg.cMap[u]; !ok && !wg.closed {
+		wg.Unlock()
+		return ErrUnknownUser
+	}
+	// the slots of a weighted task count as a single completion
+	if wg.cMap[u] > 0 {
+		wg.completed++
+	}
+	for ; n > 0 && wg.cMap[u] > 0; n-- {
+		wg.dec(u)
+	}
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
+	return nil
+}
+
+// Downgrade lowers the weight held by the user to newWeight without finishing, returning the difference to the pool
+// and waking any goroutines blocked in Next, as for a task which drops from heavy to light after an initial phase.
+// The held weight is everything the user currently holds, so tasks which downgrade independently of each other
+// should each run under their own user context. ErrUpgrade is returned if newWeight is greater than the held weight,
+// since growing must block and go through NextN, and ErrInvalidWeight if newWeight is negative.
+func (wg *WgThrottler) Downgrade(ctx context.Context, newWeight int) error {
+	if newWeight < 0 {
+		return ErrInvalidWeight
+	}
+	u, err := wg.user(ctx, "Downgrade")
+	if err != nil {
+		return err
+	}
+
+	wg.Lock()
+	held, ok := wg.cMap[u]
+	if !ok {
+		wg.Unlock()
+		return ErrUnknownUser
+	}
+	if newWeight > held {
+		wg.Unlock()
+		return ErrUpgrade
+	}
+	for ; held > newWeight; held-- {
+		wg.dec(u)
+	}
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
+	return nil
 }
 
 // Wait is functionally equivalent to a regular sync.WaitGroup's Wait() method.
-// This will force the WgThrottler to wait until all running goroutines have completed.
+// This will force the WgThrottler to wait until all running goroutines have completed, and nobody is left queued in Next().
+// As with a sync.WaitGroup, Wait returns right away if no slots are held or waited for, however quickly the work finished,
+// so the calls to Next() it should wait for must have been made before Wait is called.
 func (wg *WgThrottler) Wait() {
-	defer close(wg.ch)
-	// wait until total reaches 0
-	for range wg.ch {
-		if wg.total <= 0 {
-			break
+	wg.Lock()
+	defer wg.Unlock()
+	// the state is checked under the lock before every wait, so a Done racing with Wait can't be missed
+	for wg.total > 0 || len(wg.waiters) > 0 {
+		wg.cond.Wait()
+	}
+}
+
+// WaitChan returns a channel which is closed once no slots are held or waited for, as for Wait, so that a caller can
+// select on quiescence alongside its own signals and abandon the wait at any time. Each call returns a channel for the
+// next time the throttler becomes quiet, which is already closed if it is quiet right now.
+func (wg *WgThrottler) WaitChan() <-chan struct{} {
+	wg.Lock()
+	defer wg.Unlock()
+	ch := make(chan struct{})
+	if wg.total == 0 && len(wg.waiters) == 0 {
+		close(ch)
+		return ch
+	}
+	wg.quiet = append(wg.quiet, ch)
+	return ch
+}
+
+// quiesce closes the channels returned by WaitChan if no slots are held or waited for any more.
+// The lock must be held by the caller.
+func (wg *WgThrottler) quiesce() {
+	if wg.total > 0 || len(wg.waiters) > 0 {
+		return
+	}
+	for _, ch := range wg.quiet {
+		close(ch)
+	}
+	wg.quiet = nil
+}
+
+// Close tears down the throttler. Goroutines blocked in Next() are woken and return ErrClosed,
+// as does any later call to Next() or Use(). Slots which are still held may be returned with Done() as usual.
+// Close is safe to call multiple times and regardless of whether Wait() was ever called;
+// the recommended lifecycle is to Wait() for outstanding work and then Close().
+func (wg *WgThrottler) Close() error {
+	wg.Lock()
+	defer wg.Unlock()
+	wg.close()
+	return nil
+}
+
+// close implements Close. The lock must be held by the caller.
+func (wg *WgThrottler) close() {
+	if wg.closed {
+		return
+	}
+	wg.closed = true
+	wg.stopping = false
+	wg.paused = false
+	wg.cond.Broadcast()
+	if wg.ready != nil {
+		close(wg.ready)
+	}
+	if wg.parent != nil {
+		wg.parent.ReleaseUser(wg.parentUser)
+	}
+}
+
+// State returns the stage of its lifecycle the throttler is currently in.
+func (wg *WgThrottler) State() State {
+	wg.Lock()
+	defer wg.Unlock()
+	return wg.state()
+}
+
+// state implements State. The lock must be held by the caller.
+func (wg *WgThrottler) state() State {
+	switch {
+	case wg.closed:
+		return Closed
+	case wg.stopping:
+		return Draining
+	case wg.paused:
+		return Paused
+	}
+	return Running
+}
+
+// Pause stops the throttler granting slots, as for a maintenance window, without failing any work: goroutines blocked
+// in Next(), and any later calls, stay queued until Resume, while slots already held may be returned with Done() as usual.
+// Pausing a paused throttler has no effect. ErrInvalidTransition is returned if the throttler is draining, and ErrClosed if it is closed.
+func (wg *WgThrottler) Pause() error {
+	wg.Lock()
+	defer wg.Unlock()
+	switch wg.state() {
+	case Draining:
+		return ErrInvalidTransition
+	case Closed:
+		return ErrClosed
+	}
+	wg.paused = true
+	return nil
+}
+
+// Resume lets a paused throttler grant slots again, handing them to the goroutines queued in the meantime.
+// Resuming a running throttler has no effect. ErrInvalidTransition is returned if the throttler is draining, and ErrClosed if it is closed.
+func (wg *WgThrottler) Resume() error {
+	wg.Lock()
+	defer wg.Unlock()
+	switch wg.state() {
+	case Draining:
+		return ErrInvalidTransition
+	case Closed:
+		return ErrClosed
+	}
+	if wg.paused {
+		wg.paused = false
+		wg.cond.Broadcast()
+		if wg.total < wg.max {
+			wg.signal()
+		}
+	}
+	return nil
+}
+
+// Drain stops and flushes the work of every user, as DrainUser does for one, then closes the throttler.
+// Goroutines blocked in Next(), and any later calls to Next() or Use(), return ErrDraining, while slots already
+// held may be returned with Done() as usual. Once the last of them is, the throttler is closed as for Close and
+// Drain returns. A paused throttler may be drained, and draining one which is already draining waits alongside.
+// If ctx is canceled first, ctx.Err() is returned and the throttler is left draining. ErrClosed is returned if it is closed.
+func (wg *WgThrottler) Drain(ctx context.Context) error {
+	wg.Lock()
+	defer wg.Unlock()
+	if wg.closed {
+		return ErrClosed
+	}
+	wg.stopping = true
+	wg.paused = false
+	// wake the waiters so they give up
+	wg.cond.Broadcast()
+
+	var wake waker
+	defer wake.disarm()
+	// the waiters are let go before closing, so that they all see ErrDraining
+	for wg.total > 0 || len(wg.waiters) > 0 {
+		// Close may have been called in the meantime
+		if wg.closed {
+			return nil
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wake.arm(wg, ctx)
+		wg.cond.Wait()
 	}
+	wg.close()
+	return nil
 }
 
 // Use returns a context to be used in subsequent calls to Next() and Done().
-// Use will return nil if the total users already using the throttler meets or exceeds its max concurrency.
-func (wg *WgThrottler) Use() context.Context {
+// ErrNoUserSlots is returned if the total users already using the throttler meets or exceeds the limit set by WithMaxUsers,
+// ErrClosed if the throttler has been closed, ErrNotInitialized if it was not created with NewThrottler,
+// and ErrInvalidMax if it was created with a max less than 1.
+func (wg *WgThrottler) Use() (context.Context, error) {
+	return wg.UseFrom(context.Background())
+}
+
+// UseFrom is equivalent to Use, but derives the user context from parent rather than context.Background().
+// Values carried by parent, such as trace spans and baggage, are preserved unchanged; only the user is added.
+// Cancellation of parent also cancels any Next() blocked on the returned context, returns every slot the user
+// still holds to the pool, and releases the user as for ReleaseUser, so tasks which never notice the cancellation
+// don't leak slots. Their later calls to Done() are harmless and release nothing further.
+func (wg *WgThrottler) UseFrom(parent context.Context) (context.Context, error) {
+	return wg.register(parent, "")
+}
+
+// UseLabeled is equivalent to Use, but attaches a human-readable label to the user, such as the tenant it represents,
+// which is reported alongside the user's id by Stats and may be read back from the context with UserLabel.
+func (wg *WgThrottler) UseLabeled(label string) (context.Context, error) {
+	return wg.register(context.Background(), label)
+}
+
+// register adds a new user with the given label, deriving its context from parent.
+func (wg *WgThrottler) register(parent context.Context, label string) (context.Context, error) {
 	wg.Lock()
 	defer wg.Unlock()
-	// too many concurrent users given the max level of concurrency
-	if len(wg.cMap) >= wg.max {
-		return nil
+	return wg.add(parent, label)
+}
+
+// add registers a new user. The lock must be held by the caller.
+func (wg *WgThrottler) add(parent context.Context, label string) (context.Context, error) {
+	if wg.closed {
+		return nil, ErrClosed
+	}
+	if wg.stopping {
+		return nil, ErrDraining
+	}
+	if wg.max < 1 {
+		if wg.max == 0 && !wg.constructed {
+			return nil, ErrNotInitialized
+		}
+		return nil, ErrInvalidMax
+	}
+	// too many registered users
+	if wg.maxUsers > 0 && len(wg.cMap) >= wg.maxUsers {
+		return nil, ErrNoUserSlots
 	}
 	wg.last++
-	wg.cMap[wg.last] = 0
-	return context.WithValue(context.Background(), "user", wg.last)
+	user := wg.last
+	wg.cMap[user] = 0
+	if wg.softCap > 0 && len(wg.cMap) == wg.softCap+1 {
+		log.Printf("wgthrottler: %d live users exceeds the soft cap of %d, %d created in total; are user contexts leaking?", len(wg.cMap), wg.softCap, wg.last)
+	}
+	if parent.Done() != nil {
+		wg.stops[user] = context.AfterFunc(parent, func() {
+			wg.abandon(user)
+		})
+	}
+	ctx := context.WithValue(parent, userKey{}, user)
+	if label != "" {
+		wg.labels[user] = label
+		ctx = context.WithValue(ctx, labelKey{}, label)
+	}
+	return context.WithValue(ctx, ownerKey{}, wg), nil
 }
 
-// Next will attempt to allocate concurrency from the pool. This will block if the pool is already fully allocated
-// or if the user context cannot safely hold more concurrency without risking deadlock
-//	ctx := wg.Use()
-//  for i := 0; i < 10; i++ {
-//    wg.Next(ctx)
-//    go func(){
-//        defer wg.Done(ctx)
-// 		  MyFunc()
-//    }
-//  }
-func (wg *WgThrottler) Next(ctx context.Context) {
-	user, ok := ctx.Value("user").(int)
-	if !ok {
-		panic("wg.Next() called with invalid user context. Context must be acquired via a respective call to wg.Use()")
+// Acquire blocks until a slot is granted to the throttler's default user, for callers which just want to limit
+// concurrency to max, like a plain semaphore, without managing user contexts. The default user is registered the first
+// time it is needed and is a user like any other: while it holds or waits for slots it takes one share of the pool
+// alongside any explicit users, so mixing the two divides the pool between the default user and each of them.
+// Errors are as for Use and Next.
+func (wg *WgThrottler) Acquire() error {
+	user, err := wg.defaultUser()
+	if err != nil {
+		return err
 	}
+	return wg.Next(user)
+}
 
-	// contextMax is used to represent the maximum level of concurrency the user can maintain without the risk of deadlock
-	contextMax := wg.max / len(wg.cMap)
-	if wg.max%len(wg.cMap) > 0 {
-		contextMax++
+// Release returns a slot acquired with Acquire to the pool, as for Done.
+func (wg *WgThrottler) Release() error {
+	user, err := wg.defaultUser()
+	if err != nil {
+		return err
 	}
+	return wg.Done(user)
+}
 
-
-	if wg.get(user) >= contextMax {
-		for range wg.ch {
-			if wg.get(user) < contextMax {
-				break
-			}
+// defaultUser returns the context of the default user used by Acquire and Release, registering it on first use.
+func (wg *WgThrottler) defaultUser() (context.Context, error) {
+	wg.Lock()
+	defer wg.Unlock()
+	if wg.fallback == nil {
+		user, err := wg.add(context.Background(), "")
+		if err != nil {
+			return nil, err
 		}
+		wg.fallback = user
 	}
+	return wg.fallback, nil
+}
 
-	for wg.total >= wg.max {
-		<-wg.ch
+// abandon returns every slot held by a user whose context was canceled and releases the user.
+func (wg *WgThrottler) abandon(user int) {
+	wg.Lock()
+	if !wg.registered(user) && wg.cMap[user] == 0 {
+		wg.Unlock()
+		return
 	}
-	wg.inc(user)
+	for wg.cMap[user] > 0 {
+		wg.dec(user)
+	}
+	wg.leave(user)
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
 }
 
-func (wg *WgThrottler) get(user int) int {
+// ReleaseUser unregisters the user, returning its share of the pool to the remaining users.
+// Goroutines blocked in Next() on behalf of the user, and any later calls, return ErrUnknownUser.
+// Slots still held by the user may be returned with Done() as usual, and all of the user's bookkeeping
+// is purged as soon as the last of them is, so a long-running throttler doesn't accumulate dead users.
+func (wg *WgThrottler) ReleaseUser(ctx context.Context) error {
+	u, err := wg.user(ctx, "ReleaseUser")
+	if err != nil {
+		return err
+	}
+
 	wg.Lock()
 	defer wg.Unlock()
-	return wg.cMap[user]
+	if !wg.registered(u) {
+		return ErrUnknownUser
+	}
+	wg.leave(u)
+	return nil
 }
 
-func (wg *WgThrottler) inc(user int) int {
+// DrainUser stops and flushes the work of a single user while every other user carries on unaffected, as for
+// shutting down one tenant. Goroutines blocked in Next() on behalf of the user, and any later calls, return
+// ErrUserDraining, while slots already held may be returned with Done() as usual. Once the last of them is,
+// the user is released as for ReleaseUser, handing its share of the pool back to the others, and DrainUser returns.
+// If ctx is canceled first, ctx.Err() is returned and the user is left draining.
+func (wg *WgThrottler) DrainUser(ctx context.Context) error {
+	u, err := wg.user(ctx, "DrainUser")
+	if err != nil {
+		return err
+	}
+
 	wg.Lock()
 	defer wg.Unlock()
-	wg.cMap[user]++
-	wg.total++
-	return wg.cMap[user]
+	if !wg.registered(u) {
+		return ErrUnknownUser
+	}
+	wg.draining[u] = true
+	// wake the user's waiters so they give up
+	wg.cond.Broadcast()
+
+	var wake waker
+	defer wake.disarm()
+	for wg.pending(u) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wake.arm(wg, ctx)
+		wg.cond.Wait()
+	}
+	// the user may have been released in the meantime, in which case it is gone already
+	if wg.registered(u) {
+		wg.leave(u)
+	}
+	return nil
 }
 
-func (wg *WgThrottler) dec(user int) int {
+// leave unregisters the user, deferring the purge of its bookkeeping until it no longer holds or waits for any slots.
+// The lock must be held by the caller.
+func (wg *WgThrottler) leave(user int) {
+	wg.leaving[user] = true
+	wg.purge(user)
+	wg.cond.Broadcast()
+}
+
+// purge removes every trace of a leaving user once it has no pending work.
+func (wg *WgThrottler) purge(user int) {
+	if !wg.leaving[user] || wg.pending(user) {
+		return
+	}
+	delete(wg.cMap, user)
+	delete(wg.wMap, user)
+	delete(wg.caps, user)
+	delete(wg.leaving, user)
+	delete(wg.labels, user)
+	delete(wg.draining, user)
+	delete(wg.peaks, user)
+	delete(wg.turns, user)
+	delete(wg.started, user)
+	delete(wg.service, user)
+	delete(wg.weights, user)
+	// don't keep the user's callback alive on a long-lived parent context
+	if stop, ok := wg.stops[user]; ok {
+		stop()
+		delete(wg.stops, user)
+	}
+}
+
+// registered reports whether the user is registered and hasn't been released.
+func (wg *WgThrottler) registered(user int) bool {
+	_, ok := wg.cMap[user]
+	return ok && !wg.leaving[user]
+}
+
+// interrupted returns the reason a goroutine waiting on behalf of the users must give up, if any.
+func (wg *WgThrottler) interrupted(ctx context.Context, users ...int) error {
+	if wg.closed {
+		return ErrClosed
+	}
+	if wg.stopping {
+		return ErrDraining
+	}
+	for _, u := range users {
+		if !wg.registered(u) {
+			// a user released by the cancellation of its context reports the cancellation instead
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return ErrUnknownUser
+		}
+		if wg.draining[u] {
+			return ErrUserDraining
+		}
+	}
+	return ctx.Err()
+}
+
+// Owns reports whether ctx is a user context acquired from this throttler, or derived from one.
+func (wg *WgThrottler) Owns(ctx context.Context) bool {
+	owner, _ := ctx.Value(ownerKey{}).(*WgThrottler)
+	return owner == wg
+}
+
+type ownerKey struct{}
+
+// userKey is the context key of the user id, unexported so that no other package's values can collide with it.
+type userKey struct{}
+
+// labelKey is the context key of the label given to UseLabeled.
+type labelKey struct{}
+
+// UserLabel returns the label the user of ctx was registered with via UseLabeled, or "" if it has none,
+// so that handlers can identify the tenant in their logs.
+func UserLabel(ctx context.Context) string {
+	label, _ := ctx.Value(labelKey{}).(string)
+	return label
+}
+
+// UserID returns the id of the user ctx was acquired for via Use, e.g. for logging, and whether it carries one at all.
+func UserID(ctx context.Context) (int, bool) {
+	u, ok := ctx.Value(userKey{}).(int)
+	return u, ok
+}
+
+// acquireKey is the context key of the acquisition id stamped into the context of a task started with Go or SubmitCtx.
+type acquireKey struct{}
+
+// AcquireID returns the id of the acquisition which granted the slot a task started with Go or SubmitCtx is running in,
+// and whether ctx carries one at all. Ids increase monotonically over the life of the throttler and are distinct from
+// user ids, so that every log line of a task can be correlated with the acquisition reported to an AcquireObserver.
+// Slots taken with Next, Acquire and the like come with no task context to carry an id, so none is available for them.
+func AcquireID(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(acquireKey{}).(int64)
+	return id, ok
+}
+
+// Saturation reports how much of the pool is in use, as total/max, for the throttler ctx's user was acquired from.
+// This lets handlers further down the chain shed optional work under load using nothing but the context.
+// The value is read live, but may be slightly stale by the time it is acted upon.
+// ok is false if ctx is not derived from a user context.
+func Saturation(ctx context.Context) (ratio float64, ok bool) {
+	wg, ok := ctx.Value(ownerKey{}).(*WgThrottler)
+	if !ok {
+		return 0, false
+	}
 	wg.Lock()
 	defer wg.Unlock()
-	wg.cMap[user]--
-	wg.total--
-	wg.ch <- struct{}{}
+	if wg.max <= 0 {
+		return 1, true
+	}
+	return float64(wg.total) / float64(wg.max), true
+}
+
+// user returns the user a context was acquired for on behalf of the named method.
+// It panics if ctx carries no user at all, since that is always a programming error.
+func (wg *WgThrottler) user(ctx context.Context, method string) (int, error) {
+	if ctx == nil {
+		panic("wg." + method + "() called with nil context. Check the error returned by wg.Use()")
+	}
+	u, ok := ctx.Value(userKey{}).(int)
+	if !ok {
+		panic("wg." + method + "() called with invalid user context. Context must be acquired via a respective call to wg.Use()")
+	}
+	// contexts fabricated without an owner are left to the user lookup to reject
+	if owner, ok := ctx.Value(ownerKey{}).(*WgThrottler); ok && owner != wg {
+		return 0, ErrForeignContext
+	}
+	return u, nil
+}
+
+// Next will attempt to allocate concurrency from the pool. This will block if the pool is already fully allocated
+// or if the user context cannot safely hold more concurrency without risking deadlock.
+// A task holding a slot must not call Next again with the same plain user context, as in recursive work: once the
+// user's share is taken by its own outstanding slots, the nested call waits for a slot only the caller can release,
+// and deadlocks. The throttler cannot tell such a call from another task of the same user waiting its turn, so nested
+// calls must be made with a context marked via Reentrant.
+// ErrUnknownUser is returned if the context's user is not registered with the throttler, ErrForeignContext if the context
+// was acquired from another throttler, ErrClosed if the throttler is closed, and ctx.Err() if the context is canceled before a slot is granted.
+//	ctx, err := wg.Use()
+//  for i := 0; i < 10; i++ {
+//    wg.Next(ctx)
+//    go func(){
+//        defer wg.Done(ctx)
+// 		  MyFunc()
+//    }
+//  }
+func (wg *WgThrottler) Next(ctx context.Context) error {
+	return wg.NextPriority(ctx, Normal)
+}
+
+// NextAs is equivalent to Next, but acquires a slot for the user with the given id directly, for frameworks in which
+// threading the user context through to the call is impractical. The id is as reported by UserID.
+// Since there is no context to cancel, NextAs waits until a slot is granted, the user is released or the throttler
+// is closed. ErrUnknownUser is returned if no user with the id is registered.
+func (wg *WgThrottler) NextAs(userID int) error {
+	return wg.Next(wg.as(userID))
+}
+
+// DoneAs is equivalent to Done, but returns a slot held by the user with the given id, as acquired with NextAs.
+func (wg *WgThrottler) DoneAs(userID int) error {
+	return wg.Done(wg.as(userID))
+}
+
+// as returns a user context of wg for the given user id, which may not be registered.
+func (wg *WgThrottler) as(userID int) context.Context {
+	ctx := context.WithValue(context.Background(), userKey{}, userID)
+	return context.WithValue(ctx, ownerKey{}, wg)
+}
+
+// NextPriority is equivalent to Next, but waits in the given priority lane.
+// A freed slot is always granted to a High waiter that can take it before any Normal waiter,
+// subject to the global max, the user's fair share, and WithNormalReserve if configured.
+func (wg *WgThrottler) NextPriority(ctx context.Context, p Priority) error {
+	user, err := wg.user(ctx, "Next")
+	if err != nil {
+		return err
+	}
+	return wg.next(ctx, p, user)
+}
+
+// NextN is equivalent to Next, but atomically acquires n slots for the user, as for a task with weight n.
+// The slots are granted together, subject to the global max and the user's share, and returned with DoneN or Downgrade.
+// ErrInvalidWeight is returned if n is less than 1, and ErrExceedsMax if n is greater than the throttler's max or than
+// the user could ever hold, as limited by UserSetMax or by the fixed share of a throttler from NewThrottlerWithUsers.
+func (wg *WgThrottler) NextN(ctx context.Context, n int) error {
+	if n < 1 {
+		return ErrInvalidWeight
+	}
+	user, err := wg.user(ctx, "NextN")
+	if err != nil {
+		return err
+	}
+	users := make([]int, n)
+	for i := range users {
+		users[i] = user
+	}
+	return wg.next(ctx, Normal, users...)
+}
+
+// next acquires one slot for each of the users at once, waiting in the given lane until ctx is canceled,
+// followed by as many slots of the parent if wg was carved from one via Sub.
+// If the parent's slots can't be acquired, the slots granted by wg are returned again.
+func (wg *WgThrottler) next(ctx context.Context, p Priority, users ...int) error {
+	_, err := wg.grant(ctx, p, users...)
+	return err
+}
+
+// grant implements next, additionally returning the id of the acquisition, as reported by AcquireID.
+func (wg *WgThrottler) grant(ctx context.Context, p Priority, users ...int) (id int64, err error) {
+	// a deadline on the call's context takes precedence over the throttler's default
+	if _, ok := ctx.Deadline(); !ok && wg.timeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wg.timeout)
+		defer func() {
+			cancel()
+			if err == context.DeadlineExceeded && parent.Err() == nil {
+				err = ErrAcquireTimeout
+			}
+		}()
+	}
+
+	wg.Lock()
+	if len(users) == 1 {
+		err = wg.acquire(ctx, users[0], p)
+	} else {
+		err = wg.acquireMulti(ctx, users)
+	}
+	// the lock is still held, so the latest grant is this acquisition's
+	id = int64(wg.grants)
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
+	if err != nil {
+		return 0, err
+	}
+	return id, wg.borrow(users, func(parent *WgThrottler, pus []int) error {
+		return parent.next(ctx, p, pus...)
+	})
+}
+
+// borrow backs the slots just granted to each of the users with as many slots of the parent, taken by take,
+// if wg was carved from one via Sub. If the parent's slots can't be had, the slots granted by wg are returned again.
+func (wg *WgThrottler) borrow(users []int, take func(parent *WgThrottler, users []int) error) error {
+	if wg.parent == nil {
+		return nil
+	}
+	pu, _ := wg.parentUser.Value(userKey{}).(int)
+	pus := make([]int, len(users))
+	for i := range pus {
+		pus[i] = pu
+	}
+	err := take(wg.parent, pus)
+
+	wg.Lock()
+	if err == nil {
+		wg.lent += len(users)
+		// slots released in the meantime, as by the cancellation of a user, hand the parent's straight back
+		if wg.lent > wg.total {
+			wg.owed += wg.lent - wg.total
+			wg.lent = wg.total
+		}
+	} else {
+		for _, u := range users {
+			if wg.cMap[u] > 0 {
+				wg.dec(u)
+			}
+		}
+	}
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
+	return err
+}
+
+// TryNext is equivalent to Next, but never blocks: ErrWouldBlock is returned if a slot can't be granted right away.
+func (wg *WgThrottler) TryNext(ctx context.Context) error {
+	user, err := wg.user(ctx, "TryNext")
+	if err != nil {
+		return err
+	}
+	return wg.tryNext(ctx, user)
+}
+
+// TryNextN acquires as many of n slots for the user as are available right now, without blocking, respecting the global
+// max and the user's share as for TryNext, e.g. to size a speculative batch by the current headroom. It returns how many
+// slots it acquired, which may be 0, and a function returning exactly that many; calling it more than once has no further
+// effect. Any error which would be returned by TryNext, other than ErrWouldBlock, stops it short just the same.
+func (wg *WgThrottler) TryNextN(ctx context.Context, n int) (acquired int, release func()) {
+	user, err := wg.user(ctx, "TryNextN")
+	if err != nil {
+		return 0, func() {}
+	}
+	for acquired < n && wg.tryNext(ctx, user) == nil {
+		acquired++
+	}
+	if acquired == 0 {
+		return 0, func() {}
+	}
+
+	var once sync.Once
+	return acquired, func() {
+		once.Do(func() {
+			wg.DoneN(ctx, acquired)
+		})
+	}
+}
+
+// tryNext grants a slot to the user if one is available right now, along with a slot of the parent if wg was carved from one.
+func (wg *WgThrottler) tryNext(ctx context.Context, user int) error {
+	wg.Lock()
+	err := wg.interrupted(ctx, user)
+	if err == nil {
+		// queue the attempt only long enough to take part in the division of the pool
+		reentrant, _ := ctx.Value(reentrantKey{}).(bool)
+		w := &waiter{user: user, prio: Normal, reentrant: reentrant}
+		wg.enqueue(w)
+		ok := wg.admit(w)
+		wg.dequeue(w)
+		if ok {
+			wg.inc(user)
+		} else {
+			err = ErrWouldBlock
+		}
+	}
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
+	if err != nil {
+		return err
+	}
+	return wg.borrow([]int{user}, func(parent *WgThrottler, pus []int) error {
+		return parent.tryNext(ctx, pus[0])
+	})
+}
+
+// Ready returns a channel which receives a value whenever a slot is returned to the pool while it is not fully allocated,
+// and right away if it has free capacity when Ready is called, so that a producer can select on capacity becoming
+// available rather than block in Next:
+//	select {
+//	case <-wg.Ready():
+//	    err = wg.TryNext(ctx)
+//	case <-ctx.Done():
+//	    ...
+//	}
+// The signal is advisory: it is debounced and not tied to any particular slot, so the subsequent TryNext may still
+// fail with ErrWouldBlock if another goroutine took the slot first. The channel is closed by Close.
+func (wg *WgThrottler) Ready() <-chan struct{} {
+	wg.Lock()
+	defer wg.Unlock()
+	if wg.ready == nil {
+		wg.ready = make(chan struct{}, 1)
+		if wg.closed {
+			close(wg.ready)
+		}
+	}
+	if wg.total < wg.max {
+		wg.signal()
+	}
+	return wg.ready
+}
+
+// signal notifies the Ready channel, if there is one, without blocking. The lock must be held by the caller.
+func (wg *WgThrottler) signal() {
+	if wg.ready == nil || wg.closed || wg.paused {
+		return
+	}
+	select {
+	case wg.ready <- struct{}{}:
+	default:
+	}
+}
+
+// acquire blocks until a slot can be granted to the user in the given lane, or ctx is canceled.
+// The lock must be held by the caller.
+func (wg *WgThrottler) acquire(ctx context.Context, user int, p Priority) error {
+	// only take the timestamp when latency recording or metrics were requested
+	_, nop := wg.metrics.(NopMetrics)
+	timed := wg.latency != nil || !nop
+	var start time.Time
+	if timed {
+		start = wg.clock()
+	}
+
+	// never compute a share for a user the throttler doesn't know about, nor grant one to a canceled user
+	if err := wg.interrupted(ctx, user); err != nil {
+		return err
+	}
+
+	var wake waker
+	defer wake.disarm()
+
+	reentrant, _ := ctx.Value(reentrantKey{}).(bool)
+	w := &waiter{user: user, prio: p, reentrant: reentrant}
+	if wg.edf {
+		w.deadline, _ = ctx.Deadline()
+	}
+	wg.enqueue(w)
+	// the reasons to give up are checked first, so that a throttler closed or drained while paused, which frees
+	// capacity for the waiters as it is lifted, can't grant it to them on the way out
+	for {
+		if err := wg.interrupted(ctx, user); err != nil {
+			wg.dequeue(w)
+			// others may have been yielding to this waiter
+			wg.cond.Broadcast()
+			wg.quiesce()
+			return err
+		}
+		if wg.admit(w) {
+			break
+		}
+		wake.arm(wg, ctx)
+		wg.cond.Wait()
+	}
+	// others can only have been yielding to this waiter if the queue was ordered before it left
+	yielded := wg.ordered()
+	wg.dequeue(w)
+	wg.inc(user)
+
+	// track how long Normal work has been passed over
+	switch {
+	case p == Normal:
+		wg.highStreak = 0
+	case wg.queued(Normal):
+		wg.highStreak++
+	}
+
+	if timed {
+		waited := wg.clock().Sub(start)
+		if wg.latency != nil {
+			wg.latency.record(waited)
+		}
+		wg.metrics.ObserveWait(waited)
+		if o, ok := wg.metrics.(AcquireObserver); ok {
+			o.ObserveAcquire(int64(wg.grants), waited)
+		}
+	}
+	// a grant may unblock waiters which were yielding to this one
+	if yielded {
+		wg.cond.Broadcast()
+	}
+	return nil
+}
+
+// AcquireWithin attempts to allocate concurrency for the user context, giving up after d.
+// On success the returned release function must be called to return the slot to the pool; calling it more than once has no further effect.
+// ErrAcquireTimeout is returned if no slot was granted within d, or ctx.Err() if ctx itself is canceled first.
+func (wg *WgThrottler) AcquireWithin(ctx context.Context, d time.Duration) (release func(), err error) {
+	tctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	if err := wg.Next(tctx); err != nil {
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			return nil, ErrAcquireTimeout
+		}
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			wg.Done(ctx)
+		})
+	}, nil
+}
+
+// AcquireMulti atomically reserves one slot under each of the given user contexts, as for join-style work
+// done on behalf of several users at once. Either every reservation is granted together, respecting each user's
+// share and the global max, or AcquireMulti keeps waiting without holding any of them until ctx is canceled.
+// A user listed more than once reserves one slot per listing, and ErrExceedsMax is returned if that is more than the
+// user could ever hold, as for NextN. The returned release function returns all of the slots together; calling it more
+// than once has no further effect.
+func (wg *WgThrottler) AcquireMulti(ctx context.Context, users ...context.Context) (release func(), err error) {
+	ids := make([]int, len(users))
+	for i, user := range users {
+		if ids[i], err = wg.user(user, "AcquireMulti"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = wg.next(ctx, Normal, ids...); err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			wg.Lock()
+			for _, u := range ids {
+				if wg.cMap[u] > 0 {
+					wg.dec(u)
+				}
+			}
+			edge := wg.edge()
+			wg.Unlock()
+			edge()
+		})
+	}, nil
+}
+
+// acquireMulti blocks until one slot can be granted to each of the users at once, or ctx is canceled.
+// The lock must be held by the caller.
+func (wg *WgThrottler) acquireMulti(ctx context.Context, users []int) error {
+	if err := wg.interrupted(context.Background(), users...); err != nil {
+		return err
+	}
+	if wg.exceeds(users) {
+		return ErrExceedsMax
+	}
+
+	var wake waker
+	defer wake.disarm()
+
+	// queue a waiter per user so each of them counts towards the division of the pool
+	ws := make([]*waiter, len(users))
+	for i, u := range users {
+		ws[i] = &waiter{user: u, prio: Normal, group: ws}
+		wg.enqueue(ws[i])
+	}
+	// as for acquire, the reasons to give up are checked before any slot is granted
+	for {
+		err := wg.interrupted(ctx, users...)
+		// max or the users' ceilings may have been lowered since
+		if err == nil && wg.exceeds(users) {
+			err = ErrExceedsMax
+		}
+		if err != nil {
+			for _, w := range ws {
+				wg.dequeue(w)
+			}
+			wg.cond.Broadcast()
+			wg.quiesce()
+			return err
+		}
+		if wg.admitAll(ws) {
+			break
+		}
+		wake.arm(wg, ctx)
+		wg.cond.Wait()
+	}
+	for _, w := range ws {
+		wg.dequeue(w)
+	}
+	for _, u := range users {
+		wg.inc(u)
+	}
+	wg.highStreak = 0
+	wg.cond.Broadcast()
+	return nil
+}
+
+// SetMax changes the maximum number of slots which may be held at once while the throttler is in use.
+// Raising max wakes goroutines blocked in Next so that they may take the new slots. Lowering it never revokes
+// a slot: work already in flight runs to completion as usual, and no further slots are granted until enough
+// of it has returned its slots to bring the total below the new max. Goroutines waiting in NextN or AcquireMulti
+// for more slots than the new max could ever grant return ErrExceedsMax.
+// ErrInvalidMax is returned if max is less than 1, or too small for the reservations made via WithReservation.
+func (wg *WgThrottler) SetMax(max int) error {
+	wg.Lock()
+	err := wg.setMax(max)
+	edge := wg.edge()
+	wg.Unlock()
+	edge()
+	return err
+}
+
+// setMax applies a new max. The lock must be held by the caller.
+func (wg *WgThrottler) setMax(max int) error {
+	if max < 1 || wg.reservation*wg.maxUsers > max {
+		return ErrInvalidMax
+	}
+	if max == wg.max {
+		return nil
+	}
+	if wg.total < wg.max && wg.total >= max {
+		wg.freeAt = wg.clock()
+	}
+	wg.max = max
+	wg.cond.Broadcast()
+	if wg.total < wg.max {
+		wg.signal()
+	}
+	return nil
+}
+
+// UserSetMax sets a hard ceiling on the number of slots the user may hold, regardless of how much of the pool
+// its share would otherwise allow. The ceiling only ever lowers the share; it is not a reservation.
+// ErrInvalidLimit is returned if limit is not between 1 and the throttler's max. Goroutines waiting on behalf
+// of the user are re-evaluated immediately, so raising the ceiling can unblock them, while those in NextN or
+// AcquireMulti for more slots than the lowered ceiling allows return ErrExceedsMax.
+// As with the share, Next calls made with a Reentrant context are not bound by the ceiling.
+func (wg *WgThrottler) UserSetMax(ctx context.Context, limit int) error {
+	u, err := wg.user(ctx, "UserSetMax")
+	if err != nil {
+		return err
+	}
+
+	wg.Lock()
+	defer wg.Unlock()
+	if _, ok := wg.cMap[u]; !ok {
+		return ErrUnknownUser
+	}
+	if limit < 1 || limit > wg.max {
+		return ErrInvalidLimit
+	}
+	wg.caps[u] = limit
+	wg.cond.Broadcast()
+	return nil
+}
+
+// UserSetWeight sets the user's weight for weighted fair queueing, so that over time it receives service in proportion
+// to its weight relative to the other users. It has no effect unless the throttler was created with WithWFQ.
+// ErrInvalidWeight is returned if weight is less than 1.
+func (wg *WgThrottler) UserSetWeight(ctx context.Context, weight int) error {
+	u, err := wg.user(ctx, "UserSetWeight")
+	if err != nil {
+		return err
+	}
+
+	wg.Lock()
+	defer wg.Unlock()
+	if _, ok := wg.cMap[u]; !ok {
+		return ErrUnknownUser
+	}
+	if weight < 1 {
+		return ErrInvalidWeight
+	}
+	wg.weights[u] = weight
+	wg.cond.Broadcast()
+	return nil
+}
+
+// LatencyStats returns a snapshot of the acquisition latencies recorded by Next.
+// The zero value is returned if the throttler was not created with WithLatencyStats.
+func (wg *WgThrottler) LatencyStats() LatencyStats {
+	wg.Lock()
+	defer wg.Unlock()
+	if wg.latency == nil {
+		return LatencyStats{}
+	}
+	return wg.latency.snapshot()
+}
+
+// Stats returns a consistent snapshot of the throttler's state, taken under a single lock.
+// The snapshot is a plain value which may be encoded directly, as for an admin endpoint:
+//	http.HandleFunc("/debug/throttler", func(w http.ResponseWriter, r *http.Request) {
+//	    json.NewEncoder(w).Encode(wg.Stats())
+//	})
+func (wg *WgThrottler) Stats() Stats {
+	wg.Lock()
+	defer wg.Unlock()
+	s := Stats{
+		State:       wg.state(),
+		Max:         wg.max,
+		Total:       wg.total,
+		Users:       len(wg.cMap),
+		Held:        make(map[int]int, len(wg.cMap)),
+		Waiting:     len(wg.waiters),
+		Completed:   wg.completed,
+		MaxObserved: make(map[int]int, len(wg.peaks)),
+		Labels:      make(map[int]string, len(wg.labels)),
+	}
+	for u, label := range wg.labels {
+		s.Labels[u] = label
+	}
+	for u, n := range wg.cMap {
+		s.Held[u] = n
+	}
+	for u, n := range wg.peaks {
+		s.MaxObserved[u] = n
+	}
+	return s
+}
+
+// Completed returns the number of Done() and DoneN() calls which returned slots to the pool since the throttler was
+// created or last Reset, counting each call once however many slots it returned, e.g. for reporting how many tasks a batch ran once Wait() returns.
+func (wg *WgThrottler) Completed() int64 {
+	wg.Lock()
+	defer wg.Unlock()
+	return wg.completed
+}
+
+// Reset clears the statistics accumulated by the throttler, such as Completed(), LatencyStats() and the high-water marks in Stats(),
+// along with the service each user has received under WithWFQ. It does not affect users or slots currently held.
+func (wg *WgThrottler) Reset() {
+	wg.Lock()
+	defer wg.Unlock()
+	wg.completed = 0
+	wg.peaks = make(map[int]int)
+	wg.service = make(map[int]time.Duration)
+	if wg.latency != nil {
+		wg.latency = &latencyRecorder{}
+	}
+}
+
+// UsersCreated returns the number of users ever registered with the throttler. Compared with UserCount, it shows
+// whether users are being released: a count of created users far greater than the live count is healthy churn,
+// while live users growing along with it indicates user contexts leaking.
+func (wg *WgThrottler) UsersCreated() int {
+	wg.Lock()
+	defer wg.Unlock()
+	return wg.last
+}
+
+// UserCount returns the number of live users, including released users which still hold slots.
+func (wg *WgThrottler) UserCount() int {
+	wg.Lock()
+	defer wg.Unlock()
+	return len(wg.cMap)
+}
+
+// Healthy reports whether the throttler has had free capacity within the last maxSaturatedFor, for use as a readiness
+// probe: a pool pinned at its max for longer than that, with no slot returned in the meantime, suggests that whatever
+// the tasks depend on is wedged. A pool which is not fully allocated right now is always healthy.
+//	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+//	    if !wg.Healthy(30 * time.Second) {
+//	        w.WriteHeader(http.StatusServiceUnavailable)
+//	    }
+//	})
+func (wg *WgThrottler) Healthy(maxSaturatedFor time.Duration) bool {
+	wg.Lock()
+	defer wg.Unlock()
+	if wg.total < wg.max {
+		return true
+	}
+	return wg.clock().Sub(wg.freeAt) <= maxSaturatedFor
+}
+
+// Len returns the number of processes currently holding concurrency from the pool.
+func (wg *WgThrottler) Len() int {
+	wg.Lock()
+	defer wg.Unlock()
+	return wg.total
+}
+
+// String renders the current utilization and state of the throttler, e.g. "WgThrottler{total: 3/5, users: 2, state: running}".
+func (wg *WgThrottler) String() string {
+	wg.Lock()
+	defer wg.Unlock()
+	return fmt.Sprintf("WgThrottler{total: %d/%d, users: %d, state: %s}", wg.total, wg.max, len(wg.cMap), wg.state())
+}
+
+// waker wakes the blocked waiters of a throttler when a context is canceled so they can observe ctx.Err().
+// It is armed just before a caller first waits, so that one admitted right away never registers anything,
+// and must be stopped once the caller no longer waits.
+type waker struct {
+	stop func() bool
+}
+
+// arm registers the wake-up for ctx unless it is registered already. It must be called with the lock held.
+func (k *waker) arm(wg *WgThrottler, ctx context.Context) {
+	if k.stop != nil {
+		return
+	}
+	k.stop = context.AfterFunc(ctx, func() {
+		wg.Lock()
+		wg.cond.Broadcast()
+		wg.Unlock()
+	})
+}
+
+// disarm unregisters the wake-up, if it was armed.
+func (k *waker) disarm() {
+	if k.stop != nil {
+		k.stop()
+	}
+}
+
+// edge records a transition between saturated and having free capacity, if one occurred, and collects the slots
+// owed to the parent of a Sub throttler. It must be called with the lock held, and the returned function,
+// which delivers both, called once the lock is released.
+func (wg *WgThrottler) edge() func() {
+	notify := func() {}
+	saturated := wg.total >= wg.max
+	if wg.notifier != nil && !wg.closed && saturated != wg.saturated {
+		wg.saturated = saturated
+		wg.edges++
+		seq := wg.edges
+		notify = func() {
+			wg.notifier.notify(seq, saturated)
+		}
+	}
+	// parent slots are handed back outside the lock, so the parent's callbacks may call into this throttler
+	owed := wg.owed
+	wg.owed = 0
+	if owed == 0 {
+		return notify
+	}
+	return func() {
+		notify()
+		wg.parent.DoneN(wg.parentUser, owed)
+	}
+}
+
+// admit reports whether the waiter may be granted a slot right now.
+// A waiter must fit within both the global max and its user's share, and must not be outranked by another waiter which also fits.
+func (wg *WgThrottler) admit(w *waiter) bool {
+	if !wg.fits(w) {
+		return false
+	}
+	if !wg.ordered() {
+		return true
+	}
+	for _, o := range wg.waiters {
+		if o != w && wg.outranks(o, w) && wg.eligible(o) {
+			return false
+		}
+	}
+	return true
+}
+
+// admitAll reports whether every one of the waiters may be granted a slot at the same time.
+func (wg *WgThrottler) admitAll(ws []*waiter) bool {
+	if !wg.fitsAll(ws) {
+		return false
+	}
+	if !wg.ordered() {
+		return true
+	}
+	own := make(map[*waiter]bool, len(ws))
+	for _, w := range ws {
+		own[w] = true
+	}
+	for _, o := range wg.waiters {
+		if own[o] || !wg.eligible(o) {
+			continue
+		}
+		for _, w := range ws {
+			if wg.outranks(o, w) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fitsAll reports whether every one of the waiters' users can hold the slots they are waiting for at once
+// without exceeding the global max or their shares of it.
+func (wg *WgThrottler) fitsAll(ws []*waiter) bool {
+	if wg.paused || wg.total+len(ws) > wg.max {
+		return false
+	}
+	want := make(map[int]int, len(ws))
+	for _, w := range ws {
+		want[w.user]++
+	}
+	for u, n := range want {
+		if wg.cMap[u]+n > wg.share(u) {
+			return false
+		}
+	}
+	return true
+}
+
+// eligible reports whether a waiter could be granted its slots right now, were it not outranked, and so whether
+// others should yield to it: a waiter of a group only could if the whole group fits, else yielding to a group which
+// can't be granted, such as one wanting more than its user's share, would leave the pool idle with work queued.
+func (wg *WgThrottler) eligible(o *waiter) bool {
+	if o.group != nil {
+		return wg.fitsAll(o.group)
+	}
+	return wg.fits(o)
+}
+
+// fits reports whether the waiter's user can hold one more slot without exceeding the global max or its share of it.
+// Reentrant waiters of a user already holding a slot are only bound by the global max.
+func (wg *WgThrottler) fits(w *waiter) bool {
+	if wg.paused || wg.total+wg.reserved(w.user) >= wg.max {
+		return false
+	}
+	if w.reentrant && wg.cMap[w.user] > 0 {
+		return true
+	}
+	return wg.cMap[w.user] < wg.share(w.user)
+}
+
+// exceeds reports whether the users ask for more slots at once than the throttler could ever grant them.
+func (wg *WgThrottler) exceeds(users []int) bool {
+	if len(users) > wg.max {
+		return true
+	}
+	want := make(map[int]int, len(users))
+	for _, u := range users {
+		want[u]++
+		if want[u] > wg.ceiling(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// ceiling returns the most slots the user could ever hold at once, however other users come and go:
+// its ceiling if set via UserSetMax, and its share if the pool is divided between a fixed set of users.
+func (wg *WgThrottler) ceiling(user int) int {
+	limit := wg.max
+	if n := len(wg.cMap); wg.fixedShare && !wg.undivided && n > 0 {
+		limit = wg.max / n
+		// Ceil and Strict both allow one slot over the even split
+		if wg.max%n > 0 && wg.rounding != Floor {
+			limit++
+		}
+		if limit == 0 {
+			limit = 1
+		}
+	}
+	if c, ok := wg.caps[user]; ok && c < limit {
+		limit = c
+	}
+	return limit
+}
+
+// reserved returns the number of slots held back for active users other than the given one, per WithReservation.
+func (wg *WgThrottler) reserved(user int) int {
+	if wg.reservation <= 0 {
+		return 0
+	}
+	n := 0
+	for u, c := range wg.cMap {
+		if u != user && c < wg.reservation && wg.pending(u) {
+			n += wg.reservation - c
+		}
+	}
+	return n
+}
+
+// share returns the maximum number of slots the user may currently hold.
+func (wg *WgThrottler) share(user int) int {
+	// contextMax is used to represent the maximum level of concurrency the user can maintain without the risk of deadlock
+	if wg.undivided {
+		if limit, ok := wg.caps[user]; ok && limit < wg.max {
+			return limit
+		}
+		return wg.max
+	}
+	sharers := wg.sharers(user)
+	contextMax := wg.max / sharers
+	if rem := wg.max % sharers; rem > 0 {
+		switch wg.rounding {
+		case Ceil:
+			contextMax++
+		case Floor:
+			if contextMax == 0 {
+				contextMax = 1
+			}
+		case Strict:
+			// the remainder goes to the first users to claim it, so a user already holding an extra slot keeps it
+			if wg.cMap[user] > contextMax || wg.above(user, contextMax) < rem {
+				contextMax++
+			}
+		}
+	}
+	if limit, ok := wg.caps[user]; ok && limit < contextMax {
+		return limit
+	}
+	return contextMax
+}
+
+// above returns the number of users other than the given one holding more than n slots.
+func (wg *WgThrottler) above(user, n int) int {
+	count := 0
+	for u, c := range wg.cMap {
+		if u != user && c > n {
+			count++
+		}
+	}
+	return count
+}
+
+// sharers returns the number of users the pool is currently divided between:
+// every user holding or waiting for a slot, plus the given user.
+// Registered users with no pending work do not shrink anyone's share unless the throttler was created with a fixed user set.
+func (wg *WgThrottler) sharers(user int) int {
+	if wg.fixedShare {
+		return len(wg.cMap)
+	}
+	if wg.pending(user) {
+		return wg.active
+	}
+	return wg.active + 1
+}
+
+// pending reports whether the user holds or is waiting for any slots.
+func (wg *WgThrottler) pending(user int) bool {
+	return wg.cMap[user] > 0 || wg.wMap[user] > 0
+}
+
+// account updates the count of active users after a change to the user's slots or waiters,
+// given whether the user had pending work beforehand.
+func (wg *WgThrottler) account(user int, was bool) {
+	switch is := wg.pending(user); {
+	case is && !was:
+		if wg.wfq {
+			wg.catchUp(user)
+		}
+		wg.active++
+	case was && !is:
+		wg.active--
+	}
+}
+
+// catchUp raises the service of a user becoming active to the least service per unit of weight among the users
+// already active, as its virtual start time, so that a user joining late or returning from idle competes from where
+// the others are rather than being favored until its lifetime total catches up with theirs.
+func (wg *WgThrottler) catchUp(user int) {
+	least := time.Duration(-1)
+	for u := range wg.cMap {
+		if u == user || !wg.pending(u) {
+			continue
+		}
+		if s := wg.service[u] / time.Duration(wg.weight(u)); least < 0 || s < least {
+			least = s
+		}
+	}
+	if floor := least * time.Duration(wg.weight(user)); wg.service[user] < floor {
+		wg.service[user] = floor
+	}
+}
+
+// outranks reports whether waiter a should be granted a slot before waiter b.
+func (wg *WgThrottler) outranks(a, b *waiter) bool {
+	if a.prio == b.prio {
+		if wg.edf && !a.deadline.Equal(b.deadline) {
+			return earlier(a.deadline, b.deadline)
+		}
+		if wg.wfq {
+			// compare service per unit of weight without dividing
+			sa := wg.service[a.user] * time.Duration(wg.weight(b.user))
+			sb := wg.service[b.user] * time.Duration(wg.weight(a.user))
+			if sa != sb {
+				return sa < sb
+			}
+		}
+		// with more active users than slots, a user which just released one could otherwise take it straight back
+		// ahead of users which have been queued all along, so users take turns, least recently served first
+		return wg.oversubscribed() && wg.turns[a.user] < wg.turns[b.user]
+	}
+	// normal work is owed a slot once High has had its reserved run
+	if wg.normalReserve > 0 && wg.highStreak >= wg.normalReserve {
+		return a.prio < b.prio
+	}
+	return a.prio > b.prio
+}
+
+// weight returns the user's weight for WithWFQ.
+func (wg *WgThrottler) weight(user int) int {
+	if w, ok := wg.weights[user]; ok {
+		return w
+	}
+	return 1
+}
+
+// clock returns the current time according to the throttler's clock.
+func (wg *WgThrottler) clock() time.Time {
+	if wg.now != nil {
+		return wg.now()
+	}
+	return time.Now()
+}
+
+// earlier reports whether deadline a comes before b, where the zero time means no deadline at all.
+func earlier(a, b time.Time) bool {
+	if a.IsZero() {
+		return false
+	}
+	return b.IsZero() || a.Before(b)
+}
+
+func (wg *WgThrottler) queued(p Priority) bool {
+	return wg.lanes[p] > 0
+}
+
+// ordered reports whether any queued waiter may have to yield to another, which is never the case
+// when every waiter sits in the same lane, deadlines are ignored, and users needn't take turns.
+func (wg *WgThrottler) ordered() bool {
+	return wg.edf || wg.wfq || wg.oversubscribed() || (wg.lanes[Normal] > 0 && wg.lanes[High] > 0)
+}
+
+// oversubscribed reports whether more users hold or wait for slots than there are slots in the pool,
+// so that each share rounds up to a single slot and the shares add up to more than max.
+func (wg *WgThrottler) oversubscribed() bool {
+	return wg.active > wg.max
+}
+
+func (wg *WgThrottler) enqueue(w *waiter) {
+	was := wg.pending(w.user)
+	wg.waiters = append(wg.waiters, w)
+	wg.wMap[w.user]++
+	wg.lanes[w.prio]++
+	wg.account(w.user, was)
+}
+
+func (wg *WgThrottler) dequeue(w *waiter) {
+	was := wg.pending(w.user)
+	wg.wMap[w.user]--
+	if wg.wMap[w.user] == 0 {
+		delete(wg.wMap, w.user)
+	}
+	wg.lanes[w.prio]--
+	wg.account(w.user, was)
+	for i, o := range wg.waiters {
+		if o == w {
+			wg.waiters = append(wg.waiters[:i], wg.waiters[i+1:]...)
+			break
+		}
+	}
+	wg.purge(w.user)
+}
+
+func (wg *WgThrottler) inc(user int) int {
+	was := wg.pending(user)
+	wg.cMap[user]++
+	wg.total++
+	wg.account(user, was)
+	// the pool had free capacity right up to the grant which filled it
+	if wg.total == wg.max {
+		wg.freeAt = wg.clock()
+	}
+	if wg.cMap[user] > wg.peaks[user] {
+		wg.peaks[user] = wg.cMap[user]
+	}
+	wg.grants++
+	wg.turns[user] = wg.grants
+	if wg.started != nil {
+		wg.started[user] = append(wg.started[user], wg.clock())
+	}
+	wg.metrics.IncAcquired()
+	wg.metrics.SetInflight(wg.total)
+	if wg.violated != nil && wg.total > wg.max {
+		wg.violated(wg.total, wg.max)
+	}
+	if wg.onGrant != nil {
+		wg.onGrant(user)
+	}
 	return wg.cMap[user]
 }
+
+// dec returns one of the user's slots to the pool, reporting how long the user's oldest slot was held
+// if hold times are tracked for WithWFQ, or 0 otherwise. Which of the user's tasks is finishing isn't known here,
+// so the duration is only good for sums over all of the user's slots, not as the duration of any one task.
+func (wg *WgThrottler) dec(user int) (took time.Duration) {
+	was := wg.pending(user)
+	wg.cMap[user]--
+	wg.total--
+	if wg.lent > wg.total {
+		wg.lent--
+		wg.owed++
+	}
+	if s := wg.started[user]; len(s) > 0 {
+		took = wg.clock().Sub(s[0])
+		wg.started[user] = s[1:]
+	}
+	// slots are paired with grant times oldest first, which leaves the sum of their durations exact
+	if wg.wfq {
+		wg.service[user] += took
+	}
+	wg.account(user, was)
+	wg.purge(user)
+	wg.metrics.IncReleased()
+	wg.metrics.SetInflight(wg.total)
+	// wake Wait and every queued Next alike; each rechecks its own condition under the lock,
+	// so a burst of Done calls can't hand one caller's wakeup to another
+	wg.cond.Broadcast()
+	if wg.total < wg.max {
+		wg.signal()
+	}
+	wg.quiesce()
+	return took
+}
+
+// edgeNotifier delivers saturation transitions to the OnSaturated and OnIdle callbacks.
+// Whichever goroutine is currently dispatching delivers transitions in order on behalf of the others,
+// dropping stale or repeated states, so a callback may reenter the throttler without deadlocking.
+//  latest - Sequence number of the most recent transition handed to the notifier
+//  delivered - Sequence number of the last transition dispatched
+type edgeNotifier struct {
+	sync.Mutex
+	onSaturated  func()
+	onIdle       func()
+	latest       uint64
+	latestSat    bool
+	delivered    uint64
+	deliveredSat bool
+	dispatching  bool
+}
+
+func (n *edgeNotifier) notify(seq uint64, saturated bool) {
+	n.Lock()
+	if seq > n.latest {
+		n.latest, n.latestSat = seq, saturated
+	}
+	// the goroutine already dispatching will pick this transition up
+	if n.dispatching {
+		n.Unlock()
+		return
+	}
+	n.dispatching = true
+	for n.delivered < n.latest {
+		saturated := n.latestSat
+		changed := saturated != n.deliveredSat
+		n.delivered, n.deliveredSat = n.latest, saturated
+		n.Unlock()
+		switch {
+		case !changed:
+		case saturated && n.onSaturated != nil:
+			n.onSaturated()
+		case !saturated && n.onIdle != nil:
+			n.onIdle()
+		}
+		n.Lock()
+	}
+	n.dispatching = false
+	n.Unlock()
+}
+
+// Stats is a snapshot of a throttler's state.
+//  State - Stage of its lifecycle the throttler is in
+//  Max - Maximum allowed number of active processes
+//  Total - Number of slots currently held
+//  Users - Number of registered users, including released users which still hold slots
+//  Held - Number of slots currently held by each user
+//  Waiting - Number of goroutines blocked in Next
+//  Completed - Number of processes completed since the throttler was created or last Reset
+//  MaxObserved - Most slots held at once by each registered user since the throttler was created or last Reset,
+//    for verifying after the fact that no user exceeded its share. Released users are dropped once purged.
+//  Labels - Label of each user registered via UseLabeled
+type Stats struct {
+	State       State          `json:"state"`
+	Max         int            `json:"max"`
+	Total       int            `json:"total"`
+	Users       int            `json:"users"`
+	Held        map[int]int    `json:"held"`
+	Waiting     int            `json:"waiting"`
+	Completed   int64          `json:"completed"`
+	MaxObserved map[int]int    `json:"max_observed"`
+	Labels      map[int]string `json:"labels,omitempty"`
+}
+
+// LatencyBuckets are the upper bounds of the fixed buckets used by LatencyStats.
+// Any wait longer than the last bound is counted in a final overflow bucket.
+var LatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyStats is a summary of the time spent blocked in Next before a slot was granted.
+//  Count - Number of recorded acquisitions
+//  Min - Shortest recorded wait
+//  Max - Longest recorded wait
+//  Mean - Average recorded wait
+//  Buckets - Number of waits falling into each of LatencyBuckets, followed by the overflow bucket
+type LatencyStats struct {
+	Count   int64
+	Min     time.Duration
+	Max     time.Duration
+	Mean    time.Duration
+	Buckets []int64
+}
+
+type latencyRecorder struct {
+	count   int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+	buckets [len(LatencyBuckets) + 1]int64
+}
+
+func (r *latencyRecorder) record(d time.Duration) {
+	if r.count == 0 || d < r.min {
+		r.min = d
+	}
+	if d > r.max {
+		r.max = d
+	}
+	r.count++
+	r.sum += d
+
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	r.buckets[i]++
+}
+
+func (r *latencyRecorder) snapshot() LatencyStats {
+	stats := LatencyStats{
+		Count:   r.count,
+		Min:     r.min,
+		Max:     r.max,
+		Buckets: make([]int64, len(r.buckets)),
+	}
+	if r.count > 0 {
+		stats.Mean = r.sum / time.Duration(r.count)
+	}
+	copy(stats.Buckets, r.buckets[:])
+	return stats
+}
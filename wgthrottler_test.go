@@ -1,29 +1,2036 @@
 package wgthrottler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestThrottle(t *testing.T) {
 	th := NewThrottler(5)
-	user1, user2, user3 := th.Use(), th.Use(), th.Use()
-	go userCountdown(user1, th, t)
-	go userCountdown(user2, th, t)
-	go userCountdown(user3, th, t)
+	var producers sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		user := use(t, th)
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			userCountdown(user, th, t)
+		}()
+	}
 
+	producers.Wait()
 	th.Wait()
 	t.Log("Done!")
 }
 
+func TestWaitAfterFastTasks(t *testing.T) {
+	th := NewThrottler(4)
+	user := use(t, th)
+	for i := 0; i < 100; i++ {
+		th.Next(user)
+		go th.Done(user)
+	}
+	// every task may well have finished before Wait is called
+	time.Sleep(10 * time.Millisecond)
+
+	waited := make(chan struct{})
+	go func() {
+		th.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait blocked although every task had finished")
+	}
+}
+
 func userCountdown(user context.Context, th *WgThrottler, t *testing.T) {
 	for i := 0; i < 10; i++ {
 		th.Next(user)
 		go func(j int) {
 			defer th.Done(user)
 			time.Sleep(200 * time.Millisecond)
-			t.Log("user:", user.Value("user"), j)
+			t.Log("user:", user.Value(userKey{}), j)
 		}(i)
 	}
 }
+
+func TestLatencyStats(t *testing.T) {
+	th := NewThrottler(1, WithLatencyStats())
+	clock := useFakeClock(th)
+	user := use(t, th)
+
+	th.Next(user)
+	granted := make(chan struct{})
+	go func() {
+		// blocks until the first slot is released
+		th.Next(user)
+		close(granted)
+	}()
+	waitQueued(th, 1)
+	clock.Advance(20 * time.Millisecond)
+	th.Done(user)
+	<-granted
+
+	stats := th.LatencyStats()
+	if stats.Count != 2 {
+		t.Fatalf("expected 2 recorded acquisitions, got %d", stats.Count)
+	}
+	if stats.Min != 0 || stats.Max != 20*time.Millisecond || stats.Mean != 10*time.Millisecond {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Buckets[0] != 1 || stats.Buckets[2] != 1 {
+		t.Errorf("expected one wait in the 1ms bucket and one in the 100ms bucket, got %v", stats.Buckets)
+	}
+	var n int64
+	for _, b := range stats.Buckets {
+		n += b
+	}
+	if n != stats.Count {
+		t.Errorf("bucket counts sum to %d, expected %d", n, stats.Count)
+	}
+
+	if disabled := NewThrottler(1).LatencyStats(); disabled.Count != 0 || disabled.Buckets != nil {
+		t.Errorf("expected empty stats when recording is disabled, got %+v", disabled)
+	}
+}
+
+func TestLenString(t *testing.T) {
+	th := NewThrottler(5)
+	user := use(t, th)
+	use(t, th)
+	th.Next(user)
+	th.Next(user)
+
+	if n := th.Len(); n != 2 {
+		t.Errorf("expected Len() of 2, got %d", n)
+	}
+	if s := fmt.Sprint(th); s != "WgThrottler{total: 2/5, users: 2, state: running}" {
+		t.Errorf("unexpected String(): %s", s)
+	}
+}
+
+func TestPriorityLanes(t *testing.T) {
+	lanes := []Priority{Normal, Normal, Normal, Normal, High, High, High, High}
+	order := grantOrder(t, NewThrottler(1), lanes)
+	for i, p := range order {
+		if (i < 4) != (p == High) {
+			t.Fatalf("expected all High waiters to be granted before Normal ones, got %v", order)
+		}
+	}
+}
+
+func TestNormalReserve(t *testing.T) {
+	lanes := []Priority{Normal, Normal, High, High, High, High}
+	order := grantOrder(t, NewThrottler(1, WithNormalReserve(2)), lanes)
+	expected := []Priority{High, High, Normal, High, High, Normal}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected grant order %v, got %v", expected, order)
+		}
+	}
+}
+
+// grantOrder saturates th, queues one waiter per lane in the given order and
+// returns the order in which the waiters were granted a slot.
+func grantOrder(t *testing.T, th *WgThrottler, lanes []Priority) []Priority {
+	user := use(t, th)
+	th.Next(user)
+
+	var mu sync.Mutex
+	var order []Priority
+	var done sync.WaitGroup
+	for i, p := range lanes {
+		done.Add(1)
+		go func(p Priority) {
+			defer done.Done()
+			th.NextPriority(user, p)
+			mu.Lock()
+			order = append(order, p)
+			mu.Unlock()
+			th.Done(user)
+		}(p)
+		waitQueued(th, i+1)
+	}
+
+	th.Done(user)
+	done.Wait()
+	return order
+}
+
+// waitQueued blocks until at least n goroutines are waiting in th.Next.
+func waitQueued(th *WgThrottler, n int) {
+	for {
+		th.Lock()
+		queued := len(th.waiters)
+		th.Unlock()
+		if queued >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxUsers(t *testing.T) {
+	th := NewThrottler(2, WithMaxUsers(3))
+	for i := 0; i < 3; i++ {
+		if _, err := th.Use(); err != nil {
+			t.Fatalf("expected user %d to be registered, got %v", i+1, err)
+		}
+	}
+	if _, err := th.Use(); err != ErrNoUserSlots {
+		t.Errorf("expected ErrNoUserSlots beyond WithMaxUsers, got %v", err)
+	}
+
+	// without the option, users are not bounded by the concurrency limit
+	th = NewThrottler(2)
+	for i := 0; i < 10; i++ {
+		if _, err := th.Use(); err != nil {
+			t.Fatalf("expected user %d to be registered, got %v", i+1, err)
+		}
+	}
+}
+
+func TestShareIgnoresUsersWithoutWork(t *testing.T) {
+	th := NewThrottler(4)
+	user := use(t, th)
+	for i := 0; i < 5; i++ {
+		use(t, th)
+	}
+
+	// the only user with pending work may use the whole pool
+	for i := 0; i < 4; i++ {
+		th.Next(user)
+	}
+	if n := th.Len(); n != 4 {
+		t.Errorf("expected 4 slots in use, got %d", n)
+	}
+}
+
+func TestNextUnknownUser(t *testing.T) {
+	bogus := context.WithValue(context.Background(), userKey{}, 42)
+
+	// no users registered at all
+	th := NewThrottler(2)
+	if err := th.Next(bogus); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser, got %v", err)
+	}
+
+	// other users registered, but not this one
+	use(t, th)
+	if err := th.Next(bogus); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser, got %v", err)
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected no slots to be allocated, got %d", n)
+	}
+}
+
+func TestAcquireWithin(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	th.Next(user)
+
+	if _, err := th.AcquireWithin(user, 20*time.Millisecond); err != ErrAcquireTimeout {
+		t.Fatalf("expected ErrAcquireTimeout, got %v", err)
+	}
+	if n := len(th.waiters); n != 0 {
+		t.Errorf("expected timed out waiter to be dequeued, %d remain", n)
+	}
+
+	th.Done(user)
+	release, err := th.AcquireWithin(user, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected slot to be acquired, got %v", err)
+	}
+	release()
+	release()
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected release to return exactly one slot, %d in use", n)
+	}
+
+	// cancellation of the caller's own context is reported as such
+	th.Next(user)
+	ctx, cancel := context.WithCancel(user)
+	cancel()
+	if _, err := th.AcquireWithin(ctx, time.Second); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+type traceKey struct{}
+
+func TestUseFromPreservesParentValues(t *testing.T) {
+	th := NewThrottler(2)
+	parent := context.WithValue(context.Background(), traceKey{}, "span-1")
+	user, err := th.UseFrom(parent)
+	if err != nil {
+		t.Fatalf("unexpected error from UseFrom: %v", err)
+	}
+
+	if err := th.Next(user); err != nil {
+		t.Fatalf("unexpected error from Next: %v", err)
+	}
+	seen := make(chan interface{})
+	go func() {
+		defer th.Done(user)
+		// tasks typically derive their own context from the user context
+		task, cancel := context.WithCancel(user)
+		defer cancel()
+		seen <- task.Value(traceKey{})
+	}()
+
+	if v := <-seen; v != "span-1" {
+		t.Errorf("expected parent value to reach the task, got %v", v)
+	}
+	if _, ok := UserID(user); !ok {
+		t.Error("expected the user to be set on the derived context")
+	}
+}
+
+func TestNewThrottlerWithUsers(t *testing.T) {
+	th, users := NewThrottlerWithUsers(4, 2)
+	if len(users) != 2 || users[0] == nil || users[1] == nil {
+		t.Fatalf("expected 2 user contexts, got %v", users)
+	}
+	if users[0].Value(userKey{}) == users[1].Value(userKey{}) {
+		t.Fatal("expected distinct users")
+	}
+
+	// the first user is held to its share even while the second is idle
+	for i := 0; i < 2; i++ {
+		th.Next(users[0])
+	}
+	if _, err := th.AcquireWithin(users[0], 10*time.Millisecond); err != ErrAcquireTimeout {
+		t.Errorf("expected the first user to be limited to half the pool, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := th.AcquireWithin(users[1], 10*time.Millisecond); err != nil {
+			t.Errorf("expected the second user's share to be available, got %v", err)
+		}
+	}
+}
+
+func TestSaturationCallbacks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		}
+	}
+	var th *WgThrottler
+	th = NewThrottler(2, OnSaturated(record("saturated")), OnIdle(func() {
+		// callbacks run outside of the lock, so reentering the throttler is safe
+		th.Len()
+		record("idle")()
+	}))
+	user := use(t, th)
+
+	th.Next(user)
+	th.Next(user)
+	th.Done(user)
+	th.Done(user)
+	th.Next(user)
+
+	expected := []string{"saturated", "idle"}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+
+	// churn at the boundary never reports the same state twice in a row
+	events = nil
+	var done sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			th.Next(user)
+			th.Done(user)
+		}()
+	}
+	done.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i < len(events); i++ {
+		if events[i] == events[i-1] {
+			t.Fatalf("expected alternating events, got %v", events)
+		}
+	}
+	if len(events) > 0 && events[len(events)-1] != "idle" {
+		t.Errorf("expected the last event to report free capacity, got %v", events)
+	}
+}
+
+func TestReentrantNext(t *testing.T) {
+	th := NewThrottler(4)
+	user, other := use(t, th), use(t, th)
+	// keep a second user active so the first is held to half the pool
+	th.Next(other)
+
+	// recurse, acquiring a nested slot at each level while holding the outer one
+	var recurse func(ctx context.Context, depth int) error
+	recurse = func(ctx context.Context, depth int) error {
+		if depth == 0 {
+			return nil
+		}
+		if err := th.Next(ctx); err != nil {
+			return err
+		}
+		defer th.Done(ctx)
+		return recurse(ctx, depth-1)
+	}
+
+	// with the plain user context the third level waits on the user's own slots forever
+	ctx, cancel := context.WithTimeout(user, 20*time.Millisecond)
+	defer cancel()
+	if err := recurse(ctx, 3); err != context.DeadlineExceeded {
+		t.Fatalf("expected recursion on the plain context to block, got %v", err)
+	}
+
+	if err := recurse(Reentrant(user), 3); err != nil {
+		t.Fatalf("expected reentrant recursion to succeed, got %v", err)
+	}
+	if n := th.Len(); n != 1 {
+		t.Errorf("expected all nested slots to be released, %d in use", n)
+	}
+}
+
+func TestClose(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	th.Next(user)
+
+	blocked := make(chan error)
+	go func() {
+		blocked <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+
+	if err := th.Close(); err != nil {
+		t.Fatalf("unexpected error from Close: %v", err)
+	}
+	if err := <-blocked; err != ErrClosed {
+		t.Errorf("expected blocked Next to return ErrClosed, got %v", err)
+	}
+	if err := th.Next(user); err != ErrClosed {
+		t.Errorf("expected Next after Close to return ErrClosed, got %v", err)
+	}
+	if _, err := th.Use(); err != ErrClosed {
+		t.Errorf("expected Use after Close to return ErrClosed, got %v", err)
+	}
+	if err := th.Close(); err != nil {
+		t.Errorf("expected repeated Close to succeed, got %v", err)
+	}
+
+	// outstanding slots can still be returned, and Wait doesn't block on a closed, idle throttler
+	th.Done(user)
+	th.Wait()
+
+	// a throttler that was never waited on can be closed directly
+	if err := NewThrottler(1).Close(); err != nil {
+		t.Errorf("unexpected error from Close: %v", err)
+	}
+}
+
+func TestForeignContext(t *testing.T) {
+	a, b := NewThrottler(2), NewThrottler(2)
+	userA, userB := use(t, a), use(t, b)
+
+	if !a.Owns(userA) || a.Owns(userB) {
+		t.Error("expected a to own only its own user context")
+	}
+	if b.Owns(context.Background()) {
+		t.Error("expected a plain context not to be owned")
+	}
+
+	if err := b.Next(userA); err != ErrForeignContext {
+		t.Errorf("expected ErrForeignContext from Next, got %v", err)
+	}
+	b.Next(userB)
+	if err := b.Done(userA); err != ErrForeignContext {
+		t.Errorf("expected ErrForeignContext from Done, got %v", err)
+	}
+	if n := b.Len(); n != 1 {
+		t.Errorf("expected b's state to be untouched by the foreign context, %d in use", n)
+	}
+}
+
+func TestShareCountsOnlyActiveUsers(t *testing.T) {
+	th := NewThrottler(6)
+	first, second := use(t, th), use(t, th)
+	for i := 0; i < 4; i++ {
+		use(t, th)
+	}
+
+	// the four idle users don't count against the two active ones
+	for i := 0; i < 3; i++ {
+		th.Next(first)
+		th.Next(second)
+	}
+	if n := th.Len(); n != 6 {
+		t.Fatalf("expected the two active users to split the pool, %d in use", n)
+	}
+
+	// once the second user goes idle, the first may grow into the whole pool
+	for i := 0; i < 3; i++ {
+		th.Done(second)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := th.AcquireWithin(first, 10*time.Millisecond); err != nil {
+			t.Fatalf("expected the sole active user to use the whole pool, got %v", err)
+		}
+	}
+	if th.active != 1 {
+		t.Errorf("expected 1 active user, counted %d", th.active)
+	}
+}
+
+func TestDoneAfterClose(t *testing.T) {
+	th := NewThrottler(2)
+	user := use(t, th)
+	th.Next(user)
+	th.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := th.Done(user); err != nil {
+			t.Errorf("expected Done after Close to succeed quietly, got %v", err)
+		}
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected the held slot to be returned exactly once, %d in use", n)
+	}
+
+	// invalid contexts are reported rather than panicking
+	if err := th.Done(context.Background()); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser, got %v", err)
+	}
+	if err := th.Done(nil); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser, got %v", err)
+	}
+}
+
+func TestAcquireMulti(t *testing.T) {
+	th, users := NewThrottlerWithUsers(4, 2)
+	a, b := users[0], users[1]
+	th.Next(b)
+	th.Next(b)
+
+	// b is already at its share, so neither reservation may be taken
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := th.AcquireMulti(ctx, a, b); err != context.DeadlineExceeded {
+		t.Fatalf("expected the reservation to block, got %v", err)
+	}
+	if th.cMap[1] != 0 || th.Len() != 2 {
+		t.Fatalf("expected no partial reservation, state is %v", th)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, err := th.AcquireMulti(context.Background(), a, b)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	waitQueued(th, 2)
+	th.Done(b)
+	release := <-acquired
+
+	th.Lock()
+	held := fmt.Sprint(th.cMap)
+	th.Unlock()
+	if held != "map[1:1 2:2]" {
+		t.Errorf("expected one slot reserved for each user, got %s", held)
+	}
+	release()
+	release()
+	if n := th.Len(); n != 1 {
+		t.Errorf("expected release to return both slots exactly once, %d in use", n)
+	}
+
+	if _, err := th.AcquireMulti(context.Background(), a, b, a, b, a); err != ErrExceedsMax {
+		t.Errorf("expected ErrExceedsMax, got %v", err)
+	}
+}
+
+func TestUserSetMax(t *testing.T) {
+	th := NewThrottler(4)
+	user := use(t, th)
+	if err := th.UserSetMax(user, 1); err != nil {
+		t.Fatalf("unexpected error from UserSetMax: %v", err)
+	}
+
+	th.Next(user)
+	unblocked := make(chan error)
+	go func() {
+		unblocked <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+
+	// raising the ceiling lets the waiting goroutine through
+	if err := th.UserSetMax(user, 2); err != nil {
+		t.Fatalf("unexpected error from UserSetMax: %v", err)
+	}
+	if err := <-unblocked; err != nil {
+		t.Fatalf("unexpected error from Next: %v", err)
+	}
+	if _, err := th.AcquireWithin(user, 10*time.Millisecond); err != ErrAcquireTimeout {
+		t.Errorf("expected the user to be held to its ceiling of 2, got %v", err)
+	}
+
+	for _, limit := range []int{0, -1, 5} {
+		if err := th.UserSetMax(user, limit); err != ErrInvalidLimit {
+			t.Errorf("expected ErrInvalidLimit for %d, got %v", limit, err)
+		}
+	}
+}
+
+func TestEDF(t *testing.T) {
+	th := NewThrottler(1, WithEDF())
+	user := use(t, th)
+	th.Next(user)
+
+	for round := 0; round < 5; round++ {
+		granted := make(chan string, 3)
+		queue := func(name string, ctx context.Context, n int) {
+			go func() {
+				if err := th.Next(ctx); err != nil {
+					t.Error(err)
+				}
+				granted <- name
+			}()
+			waitQueued(th, n)
+		}
+		none := user
+		far, cancelFar := context.WithTimeout(user, time.Hour)
+		near, cancelNear := context.WithTimeout(user, time.Minute)
+		queue("none", none, 1)
+		queue("far", far, 2)
+		queue("near", near, 3)
+
+		var order []string
+		for i := 0; i < 3; i++ {
+			th.Done(user)
+			order = append(order, <-granted)
+		}
+		cancelFar()
+		cancelNear()
+		if fmt.Sprint(order) != "[near far none]" {
+			t.Fatalf("round %d: expected earliest deadline first, got %v", round, order)
+		}
+	}
+}
+
+func TestReleaseUser(t *testing.T) {
+	th := NewThrottler(2)
+	user := use(t, th)
+	th.Next(user)
+	th.Next(user)
+
+	blocked := make(chan error)
+	go func() {
+		blocked <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+
+	if err := th.ReleaseUser(user); err != nil {
+		t.Fatalf("unexpected error from ReleaseUser: %v", err)
+	}
+	if err := <-blocked; err != ErrUnknownUser {
+		t.Errorf("expected the blocked Next to return ErrUnknownUser, got %v", err)
+	}
+	if err := th.Next(user); err != ErrUnknownUser {
+		t.Errorf("expected Next on a released user to return ErrUnknownUser, got %v", err)
+	}
+	if err := th.ReleaseUser(user); err != ErrUnknownUser {
+		t.Errorf("expected a second release to return ErrUnknownUser, got %v", err)
+	}
+
+	// held slots are still returned, after which the user is purged
+	th.Done(user)
+	if _, ok := th.cMap[1]; !ok {
+		t.Fatal("expected the user to remain until its last slot is returned")
+	}
+	th.Done(user)
+	if _, ok := th.cMap[1]; ok {
+		t.Error("expected the user to be purged")
+	}
+}
+
+func TestReleaseUserChurn(t *testing.T) {
+	th := NewThrottler(4, WithLatencyStats())
+	for i := 0; i < 5000; i++ {
+		user := use(t, th)
+		th.Next(user)
+		th.UserSetMax(user, 2)
+		if i%2 == 0 {
+			// release while still holding a slot
+			th.ReleaseUser(user)
+			th.Done(user)
+		} else {
+			th.Done(user)
+			th.ReleaseUser(user)
+		}
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	if n := len(th.cMap) + len(th.wMap) + len(th.caps) + len(th.leaving); n != 0 {
+		t.Errorf("expected no per-user bookkeeping to be retained, found %d entries", n)
+	}
+	if th.active != 0 || th.total != 0 {
+		t.Errorf("expected an idle throttler, got %d active users and %d slots", th.active, th.total)
+	}
+}
+
+func TestCompleted(t *testing.T) {
+	th := NewThrottler(2, WithLatencyStats())
+	user := use(t, th)
+	for i := 0; i < 5; i++ {
+		th.Next(user)
+		th.Done(user)
+	}
+	// an unmatched Done is not counted
+	th.Done(user)
+	if n := th.Completed(); n != 5 {
+		t.Errorf("expected 5 completions, got %d", n)
+	}
+
+	th.Reset()
+	if n := th.Completed(); n != 0 {
+		t.Errorf("expected Reset to clear completions, got %d", n)
+	}
+	if n := th.LatencyStats().Count; n != 0 {
+		t.Errorf("expected Reset to clear latency stats, got %d", n)
+	}
+}
+
+func TestGrantHook(t *testing.T) {
+	th := NewThrottler(5)
+	grants := make(chan int, 10)
+	th.onGrant = func(user int) {
+		grants <- user
+	}
+	user := use(t, th)
+
+	go func() {
+		for i := 0; i < 6; i++ {
+			th.Next(user)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		<-grants
+	}
+
+	// the 6th acquisition blocks until one of the first 5 completes
+	waitQueued(th, 1)
+	select {
+	case <-grants:
+		t.Fatal("expected the 6th acquisition to block")
+	default:
+	}
+	th.Done(user)
+	<-grants
+}
+
+// fakeClock is a manually advanced clock for deterministic timing in tests.
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+// useFakeClock replaces th's clock with a fakeClock.
+func useFakeClock(th *WgThrottler) *fakeClock {
+	c := &fakeClock{t: time.Unix(0, 0)}
+	th.now = c.Now
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// use registers a new user with th, failing the test if it cannot.
+func use(t *testing.T, th *WgThrottler) context.Context {
+	t.Helper()
+	user, err := th.Use()
+	if err != nil {
+		t.Fatalf("unexpected error from Use: %v", err)
+	}
+	return user
+}
+
+func TestReservation(t *testing.T) {
+	th := NewThrottler(5, WithMaxUsers(3), WithReservation(1))
+	busy, other, late := use(t, th), use(t, th), use(t, th)
+	for i := 0; i < 3; i++ {
+		th.Next(busy)
+	}
+	th.Next(other)
+	th.Next(other)
+
+	granted := make(chan string, 2)
+	queue := func(name string, user context.Context, n int) {
+		go func() {
+			th.Next(user)
+			granted <- name
+		}()
+		waitQueued(th, n)
+	}
+	queue("late", late, 1)
+	queue("other", other, 2)
+
+	// both waiters are within their share, but the freed slot is reserved for the late user
+	th.Done(other)
+	if name := <-granted; name != "late" {
+		t.Fatalf("expected the newly active user to receive its reservation, %s did", name)
+	}
+	th.Done(busy)
+	<-granted
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected reservations exceeding max to be rejected")
+		}
+	}()
+	NewThrottler(5, WithMaxUsers(3), WithReservation(2))
+}
+
+func TestSaturation(t *testing.T) {
+	th := NewThrottler(4)
+	user := use(t, th)
+	th.Next(user)
+
+	// handlers only see a context derived from the user context
+	handler, cancel := context.WithCancel(user)
+	defer cancel()
+	if ratio, ok := Saturation(handler); !ok || ratio != 0.25 {
+		t.Errorf("expected saturation of 0.25, got %v (%v)", ratio, ok)
+	}
+	th.Next(user)
+	th.Next(user)
+	if ratio, _ := Saturation(handler); ratio != 0.75 {
+		t.Errorf("expected saturation of 0.75, got %v", ratio)
+	}
+
+	if _, ok := Saturation(context.Background()); ok {
+		t.Error("expected no saturation for a plain context")
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	th := NewThrottler(4)
+	heavy, light := use(t, th), use(t, th)
+	if err := th.NextN(heavy, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.NextN(light, 2)
+	}()
+	waitQueued(th, 2)
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected NextN to block while the heavy task holds 3 slots, got %v", err)
+	default:
+	}
+
+	if err := th.Downgrade(heavy, 4); err != ErrUpgrade {
+		t.Errorf("expected ErrUpgrade, got %v", err)
+	}
+	if err := th.Downgrade(heavy, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if n := th.Len(); n != 3 {
+		t.Errorf("expected 3 slots in use after the downgrade, got %d", n)
+	}
+
+	th.Done(heavy)
+	if err := th.DoneN(light, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected every slot returned, %d in use", n)
+	}
+	if err := th.NextN(heavy, 5); err != ErrExceedsMax {
+		t.Errorf("expected ErrExceedsMax, got %v", err)
+	}
+	if err := th.NextN(heavy, 0); err != ErrInvalidWeight {
+		t.Errorf("expected ErrInvalidWeight, got %v", err)
+	}
+}
+
+func TestCancelReleasesSlots(t *testing.T) {
+	th := NewThrottler(2)
+	parent, cancel := context.WithCancel(context.Background())
+	user, err := th.UseFrom(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th.Next(user)
+	th.Next(user)
+
+	other := use(t, th)
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.Next(other)
+	}()
+	waitQueued(th, 1)
+
+	// the tasks holding the slots never call Done
+	cancel()
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if n := th.Len(); n != 1 {
+		t.Errorf("expected the canceled user's slots back in the pool, %d in use", n)
+	}
+	th.Lock()
+	_, known := th.cMap[1]
+	th.Unlock()
+	if known {
+		t.Error("expected the canceled user to be released")
+	}
+
+	// late Done calls from the abandoned tasks must not release the other user's slot
+	for i := 0; i < 2; i++ {
+		if err := th.Done(user); err != nil {
+			t.Errorf("expected a late Done to be harmless, got %v", err)
+		}
+	}
+	if n := th.Len(); n != 1 {
+		t.Errorf("expected late Done calls to release nothing, %d in use", n)
+	}
+	if err := th.Next(user); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestStatsMaxObserved(t *testing.T) {
+	th := NewThrottler(4)
+	a, b := use(t, th), use(t, th)
+	for i := 0; i < 3; i++ {
+		th.Next(a)
+	}
+	th.Done(a)
+	th.Next(b)
+
+	s := th.Stats()
+	if s.Max != 4 || s.Total != 3 {
+		t.Errorf("expected 3/4 slots in use, got %d/%d", s.Total, s.Max)
+	}
+	if got := fmt.Sprint(s.MaxObserved); got != "map[1:3 2:1]" {
+		t.Errorf("expected high-water marks of 3 and 1, got %s", got)
+	}
+
+	th.Reset()
+	th.Next(b)
+	if got := fmt.Sprint(th.Stats().MaxObserved); got != "map[2:2]" {
+		t.Errorf("expected the high-water marks to restart after Reset, got %s", got)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	th := NewThrottler(2)
+	a, b := use(t, th), use(t, th)
+	th.Next(a)
+	th.Next(a)
+	th.Done(a)
+	th.Next(b)
+	go th.Next(a)
+	waitQueued(th, 1)
+
+	got, err := json.Marshal(th.Stats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"state":"running","max":2,"total":2,"users":2,"held":{"1":1,"2":1},"waiting":1,"completed":1,"max_observed":{"1":2,"2":1}}`
+	if string(got) != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestMoreUsersThanSlots(t *testing.T) {
+	const users, max, grants = 5, 2, 1000
+	th := NewThrottler(max)
+	var stop int32
+	counts := make(map[int]int)
+	th.onGrant = func(user int) {
+		counts[user]++
+		if th.completed+int64(th.total) >= grants {
+			atomic.StoreInt32(&stop, 1)
+		}
+	}
+
+	// hold the pool until every user is queued
+	gate := use(t, th)
+	for i := 0; i < max; i++ {
+		th.Next(gate)
+	}
+	var done sync.WaitGroup
+	for i := 0; i < users; i++ {
+		user := use(t, th)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			// release and immediately ask again, which would let a user barge ahead of everyone queued
+			for atomic.LoadInt32(&stop) == 0 {
+				th.Next(user)
+				th.Done(user)
+			}
+		}()
+	}
+	waitQueued(th, users)
+	for i := 0; i < max; i++ {
+		th.Done(gate)
+	}
+	done.Wait()
+
+	th.Lock()
+	defer th.Unlock()
+	for u := 2; u <= users+1; u++ {
+		if counts[u] < grants/users/2 {
+			t.Errorf("expected every user to take its turn, got %v", counts)
+			break
+		}
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	var th WgThrottler
+	if _, err := th.Use(); err != ErrNotInitialized {
+		t.Errorf("expected ErrNotInitialized, got %v", err)
+	}
+	if err := th.Done(context.WithValue(context.Background(), userKey{}, 1)); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser, got %v", err)
+	}
+	if s := th.String(); s != "WgThrottler{total: 0/0, users: 0, state: running}" {
+		t.Errorf("unexpected state %s", s)
+	}
+	th.Reset()
+	if err := th.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// as opposed to one created with no capacity
+	if _, err := NewThrottler(0).Use(); err != ErrInvalidMax {
+		t.Errorf("expected ErrInvalidMax, got %v", err)
+	}
+
+	// a literal with max set works like one from NewThrottler
+	lit := &WgThrottler{max: 1}
+	user := use(t, lit)
+	if err := lit.Next(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := lit.Done(user); err != nil {
+		t.Fatal(err)
+	}
+	if n := lit.Completed(); n != 1 {
+		t.Errorf("expected 1 completion, got %d", n)
+	}
+}
+
+func TestSub(t *testing.T) {
+	th := NewThrottler(4)
+	child := th.Sub(2)
+	user := use(t, child)
+	child.Next(user)
+	child.Next(user)
+	if n := th.Len(); n != 2 {
+		t.Fatalf("expected the child's slots to be held in the parent, %d in use", n)
+	}
+
+	// the child is at its limit, while the rest of the parent stays available
+	ctx, cancel := context.WithTimeout(user, 20*time.Millisecond)
+	defer cancel()
+	if err := child.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the child to be limited to 2 slots, got %v", err)
+	}
+	other := use(t, th)
+	th.Next(other)
+	th.Next(other)
+
+	// the parent is full, so a slot granted by the child is handed back when the parent's can't be had
+	child.Done(user)
+	th.Next(use(t, th))
+	ctx, cancel = context.WithTimeout(user, 20*time.Millisecond)
+	defer cancel()
+	if err := child.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the full parent to block the child, got %v", err)
+	}
+	if child.Len() != 1 || th.Len() != 4 {
+		t.Fatalf("expected no slot left behind by the failed acquisition, got %v and %v", child, th)
+	}
+
+	child.Done(user)
+	if child.Len() != 0 || th.Len() != 3 {
+		t.Errorf("expected releasing the child's slot to release the parent's too, got %v and %v", child, th)
+	}
+	child.Close()
+	if s := th.String(); s != "WgThrottler{total: 3/4, users: 2, state: running}" {
+		t.Errorf("expected closing the child to release its user of the parent, got %s", s)
+	}
+}
+
+func TestReadyTryNext(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	if err := th.TryNext(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.TryNext(user); err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got %v", err)
+	}
+
+	ready := th.Ready()
+	select {
+	case <-ready:
+		t.Fatal("expected no signal while the pool is full")
+	default:
+	}
+	th.Done(user)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("expected a signal once a slot was returned")
+	}
+	if err := th.TryNext(user); err != nil {
+		t.Fatalf("expected the signaled slot to be available, got %v", err)
+	}
+
+	th.Close()
+	if _, ok := <-th.Ready(); ok {
+		t.Error("expected Close to close the channel")
+	}
+	if err := th.TryNext(user); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSetMax(t *testing.T) {
+	th := NewThrottler(3)
+	user := use(t, th)
+	for i := 0; i < 3; i++ {
+		th.Next(user)
+	}
+	waiting := make(chan error)
+	go func() {
+		waiting <- th.NextN(user, 3)
+	}()
+	waitQueued(th, 3)
+
+	if err := th.SetMax(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waiting; err != ErrExceedsMax {
+		t.Errorf("expected a request larger than the new max to fail, got %v", err)
+	}
+
+	// lowering max strands nothing: the in-flight work finishes, and only then are new slots granted
+	th.Done(user)
+	if err := th.TryNext(user); err != ErrWouldBlock {
+		t.Fatalf("expected no slot until the total drops below the new max, got %v", err)
+	}
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+	if err := th.SetMax(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if s := th.String(); s != "WgThrottler{total: 3/3, users: 1, state: running}" {
+		t.Errorf("unexpected state %s", s)
+	}
+	if err := th.SetMax(0); err != ErrInvalidMax {
+		t.Errorf("expected ErrInvalidMax, got %v", err)
+	}
+}
+
+func TestNextAs(t *testing.T) {
+	th := NewThrottler(2)
+	user := use(t, th)
+	id, ok := UserID(user)
+	if !ok {
+		t.Fatal("expected the user context to carry an id")
+	}
+
+	// a middleware reusing the old string key must not misattribute the work
+	overwritten := context.WithValue(user, "user", id+1)
+	if err := th.Next(overwritten); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.NextAs(id); err != nil {
+		t.Fatal(err)
+	}
+	th.Lock()
+	held := th.cMap[id]
+	th.Unlock()
+	if held != 2 {
+		t.Errorf("expected both slots attributed to user %d, got %d", id, held)
+	}
+	if err := th.DoneAs(id); err != nil {
+		t.Fatal(err)
+	}
+	th.Done(user)
+
+	if err := th.NextAs(id + 1); err != ErrUnknownUser {
+		t.Errorf("expected ErrUnknownUser, got %v", err)
+	}
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected every slot returned, %d in use", n)
+	}
+}
+
+func TestDrainUser(t *testing.T) {
+	th := NewThrottler(3)
+	drained, a, b := use(t, th), use(t, th), use(t, th)
+	th.Next(drained)
+
+	var progress [2]int64
+	stop := make(chan struct{})
+	var running sync.WaitGroup
+	for i, user := range []context.Context{a, b} {
+		running.Add(1)
+		go func(i int, user context.Context) {
+			defer running.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := th.Next(user); err != nil {
+					t.Error(err)
+					return
+				}
+				atomic.AddInt64(&progress[i], 1)
+				th.Done(user)
+			}
+		}(i, user)
+	}
+
+	drainErr := make(chan error)
+	go func() {
+		drainErr <- th.DrainUser(drained)
+	}()
+	id, _ := UserID(drained)
+	for {
+		th.Lock()
+		draining := th.draining[id]
+		th.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := th.Next(drained); err != ErrUserDraining {
+		t.Errorf("expected ErrUserDraining, got %v", err)
+	}
+
+	// the others keep going while the drained user still holds its slot
+	before := [2]int64{atomic.LoadInt64(&progress[0]), atomic.LoadInt64(&progress[1])}
+	for i := range before {
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&progress[i]) == before[i] && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if atomic.LoadInt64(&progress[i]) == before[i] {
+			t.Errorf("expected user %d to make progress during the drain", i)
+		}
+	}
+	select {
+	case err := <-drainErr:
+		t.Fatalf("expected DrainUser to wait for the held slot, got %v", err)
+	default:
+	}
+
+	th.Done(drained)
+	if err := <-drainErr; err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Next(drained); err != ErrUnknownUser {
+		t.Errorf("expected the drained user to be released, got %v", err)
+	}
+	close(stop)
+	running.Wait()
+}
+
+func TestUseLabeled(t *testing.T) {
+	th := NewThrottler(2)
+	user, err := th.UseLabeled("tenant-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := use(t, th)
+	if label := UserLabel(user); label != "tenant-a" {
+		t.Errorf("expected the label on the context, got %q", label)
+	}
+	if label := UserLabel(plain); label != "" {
+		t.Errorf("expected no label, got %q", label)
+	}
+	if got := fmt.Sprint(th.Stats().Labels); got != "map[1:tenant-a]" {
+		t.Errorf("expected the label in Stats, got %s", got)
+	}
+
+	th.ReleaseUser(user)
+	if n := len(th.Stats().Labels); n != 0 {
+		t.Errorf("expected the label to be purged with the user, %d left", n)
+	}
+}
+
+func TestTryNextN(t *testing.T) {
+	th := NewThrottler(4)
+	user, other := use(t, th), use(t, th)
+	th.Next(other)
+
+	// the user's share of the pool is 2 while the other user is active
+	n, release := th.TryNextN(user, 3)
+	if n != 2 {
+		t.Fatalf("expected 2 of the 3 slots, got %d", n)
+	}
+	if n, none := th.TryNextN(user, 1); n != 0 {
+		none()
+		t.Fatalf("expected nothing left for the user, got %d", n)
+	}
+	release()
+	release()
+	if l := th.Len(); l != 1 {
+		t.Errorf("expected release to return exactly the acquired slots once, %d in use", l)
+	}
+}
+
+func TestUserCounts(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	th := NewThrottler(2, WithUserSoftCap(2))
+	for i := 0; i < 5; i++ {
+		th.ReleaseUser(use(t, th))
+	}
+	if logged.Len() != 0 {
+		t.Errorf("expected no warning while users are released, got %q", logged.String())
+	}
+	for i := 0; i < 4; i++ {
+		use(t, th)
+	}
+	if created, live := th.UsersCreated(), th.UserCount(); created != 9 || live != 4 {
+		t.Errorf("expected 9 users created and 4 live, got %d and %d", created, live)
+	}
+	if n := strings.Count(logged.String(), "soft cap"); n != 1 {
+		t.Errorf("expected one warning on exceeding the soft cap, got %q", logged.String())
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	th := NewThrottler(2)
+	if err := th.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if s := th.String(); s != "WgThrottler{total: 2/2, users: 1, state: running}" {
+		t.Fatalf("expected both slots held by a single default user, got %s", s)
+	}
+
+	// an explicit user shares the global max with the default user
+	user := use(t, th)
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+	th.Release()
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	th.Release()
+	th.Done(user)
+	if n := th.Len(); n != 0 {
+		t.Errorf("expected every slot returned, %d in use", n)
+	}
+
+	th.Close()
+	if err := th.Acquire(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestInvariantCheck(t *testing.T) {
+	// twice as many users as slots, where rounding each share up to one slot used to over-allocate the pool
+	const users, max = 10, 5
+	var violations int64
+	th := NewThrottler(max, WithInvariantCheck(func(total, max int) {
+		atomic.AddInt64(&violations, 1)
+	}))
+
+	var done sync.WaitGroup
+	for i := 0; i < users; i++ {
+		user := use(t, th)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			for j := 0; j < 50; j++ {
+				th.Next(user)
+				th.Done(user)
+			}
+		}()
+	}
+	done.Wait()
+	if n := atomic.LoadInt64(&violations); n != 0 {
+		t.Errorf("expected the global max to hold, violated %d times", n)
+	}
+
+	// force an over-allocation to prove the check fires
+	th.Lock()
+	for i := 0; i <= max; i++ {
+		th.inc(1)
+	}
+	th.Unlock()
+	if n := atomic.LoadInt64(&violations); n != 1 {
+		t.Errorf("expected the forced over-allocation to be reported once, got %d", n)
+	}
+}
+
+func TestWaitChan(t *testing.T) {
+	th := NewThrottler(2)
+	select {
+	case <-th.WaitChan():
+	default:
+		t.Fatal("expected an idle throttler to return a closed channel")
+	}
+
+	user := use(t, th)
+	th.Next(user)
+	th.Next(user)
+	first, second := th.WaitChan(), th.WaitChan()
+	th.Done(user)
+	select {
+	case <-first:
+		t.Fatal("expected the channel to stay open while a slot is held")
+	default:
+	}
+
+	th.Done(user)
+	for _, ch := range []<-chan struct{}{first, second} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("expected every channel to close once the throttler was quiet")
+		}
+	}
+}
+
+func TestWFQ(t *testing.T) {
+	th := NewThrottler(1, WithWFQ())
+	clock := useFakeClock(th)
+	fast, slow := use(t, th), use(t, th)
+	// the slow user is owed twice the service of the fast one
+	th.UserSetWeight(slow, 2)
+
+	// hold the slot until both users are queued, with enough workers each that they stay queued throughout
+	th.Next(fast)
+	const workers = 3
+	var grants int64
+	var running sync.WaitGroup
+	for _, u := range []struct {
+		user context.Context
+		took time.Duration
+	}{{fast, time.Millisecond}, {slow, 3 * time.Millisecond}} {
+		for i := 0; i < workers; i++ {
+			running.Add(1)
+			go func(user context.Context, took time.Duration) {
+				defer running.Done()
+				for atomic.AddInt64(&grants, 1) <= 600 {
+					th.Next(user)
+					clock.Advance(took)
+					th.Done(user)
+				}
+			}(u.user, u.took)
+		}
+	}
+	waitQueued(th, 2*workers)
+	th.Done(fast)
+	running.Wait()
+
+	th.Lock()
+	defer th.Unlock()
+	got := float64(th.service[2]) / float64(th.service[1])
+	if got < 1.8 || got > 2.2 {
+		t.Errorf("expected service proportional to weight, got %v for the fast user and %v for the slow one", th.service[1], th.service[2])
+	}
+}
+
+func TestWaitDuringBursts(t *testing.T) {
+	const max, queued, rounds = 8, 32, 50
+	th := NewThrottler(max)
+	user := use(t, th)
+	for i := 0; i < rounds; i++ {
+		// fill every slot, queue more callers behind them, then return every held slot at once
+		// while both Wait and the queued calls to Next are woken by the same burst
+		for j := 0; j < max; j++ {
+			th.Next(user)
+		}
+		var queue sync.WaitGroup
+		for j := 0; j < queued; j++ {
+			queue.Add(1)
+			go func() {
+				defer queue.Done()
+				th.Next(user)
+				th.Done(user)
+			}()
+		}
+		waitQueued(th, queued)
+
+		waited := make(chan struct{})
+		go func() {
+			th.Wait()
+			close(waited)
+		}()
+		start := make(chan struct{})
+		for j := 0; j < max; j++ {
+			go func() {
+				<-start
+				th.Done(user)
+			}()
+		}
+		close(start)
+		select {
+		case <-waited:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: Wait missed the throttler going idle, %v", i, th)
+		}
+		queue.Wait()
+	}
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	th := NewThrottler(1, WithAcquireTimeout(20*time.Millisecond))
+	user := use(t, th)
+	if err := th.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Next(user); err != ErrAcquireTimeout {
+		t.Fatalf("expected ErrAcquireTimeout, got %v", err)
+	}
+	if err := th.Acquire(); err != ErrAcquireTimeout {
+		t.Fatalf("expected ErrAcquireTimeout from Acquire, got %v", err)
+	}
+	// a canceled context is reported as such, not as a timeout
+	canceled, cancel := context.WithCancel(user)
+	cancel()
+	if err := th.Next(canceled); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if s := th.String(); s != "WgThrottler{total: 1/1, users: 2, state: running}" {
+		t.Errorf("expected the timed out calls to leave no slots behind, got %s", s)
+	}
+}
+
+func TestAcquireTimeoutOverride(t *testing.T) {
+	th := NewThrottler(1, WithAcquireTimeout(10*time.Millisecond))
+	user := use(t, th)
+	th.Next(user)
+
+	// a deadline on the call outlasts the default, so the slot freed in the meantime is granted
+	ctx, cancel := context.WithTimeout(user, time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		th.Done(user)
+	}()
+	if err := th.Next(ctx); err != nil {
+		t.Fatalf("expected the call's deadline to override the default, got %v", err)
+	}
+
+	// and one sooner than the default is reported as the context's own error
+	short, cancel := context.WithTimeout(user, time.Millisecond)
+	defer cancel()
+	if err := th.Next(short); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestState(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	if s := th.State(); s != Running {
+		t.Fatalf("expected a new throttler to be running, got %v", s)
+	}
+	if err := th.Resume(); err != nil {
+		t.Errorf("expected resuming a running throttler to have no effect, got %v", err)
+	}
+
+	// a paused throttler queues calls to Next until it is resumed
+	th.Next(user)
+	if err := th.Pause(); err != nil || th.State() != Paused {
+		t.Fatalf("expected the throttler to pause, got %v in state %v", err, th.State())
+	}
+	th.Done(user)
+	if err := th.TryNext(user); err != ErrWouldBlock {
+		t.Fatalf("expected no slot while paused, got %v", err)
+	}
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+	if err := th.Resume(); err != nil || th.State() != Running {
+		t.Fatalf("expected the throttler to resume, got %v in state %v", err, th.State())
+	}
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected the queued call to be granted on Resume, got %v", err)
+	}
+
+	// draining turns away new work while the held slot is returned, then closes the throttler
+	th.Pause()
+	queued := make(chan error)
+	go func() {
+		queued <- th.Next(user)
+	}()
+	waitQueued(th, 1)
+	drained := make(chan error)
+	go func() {
+		drained <- th.Drain(context.Background())
+	}()
+	if err := <-queued; err != ErrDraining {
+		t.Fatalf("expected the queued call to fail with ErrDraining, got %v", err)
+	}
+	if s := th.String(); s != "WgThrottler{total: 1/1, users: 1, state: draining}" {
+		t.Errorf("expected the state in the string, got %s", s)
+	}
+	if _, err := th.Use(); err != ErrDraining {
+		t.Errorf("expected ErrDraining from Use, got %v", err)
+	}
+	if err := th.Pause(); err != ErrInvalidTransition {
+		t.Errorf("expected pausing a draining throttler to fail, got %v", err)
+	}
+	if err := th.Resume(); err != ErrInvalidTransition {
+		t.Errorf("expected resuming a draining throttler to fail, got %v", err)
+	}
+	th.Done(user)
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+
+	if s := th.Stats().State; s != Closed {
+		t.Fatalf("expected the drained throttler to be closed, got %v", s)
+	}
+	if err := th.Resume(); err != ErrClosed {
+		t.Errorf("expected resuming a closed throttler to fail, got %v", err)
+	}
+	if err := th.Pause(); err != ErrClosed {
+		t.Errorf("expected pausing a closed throttler to fail, got %v", err)
+	}
+	if err := th.Drain(context.Background()); err != ErrClosed {
+		t.Errorf("expected draining a closed throttler to fail, got %v", err)
+	}
+}
+
+func TestCloseOrDrainWhilePaused(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(th *WgThrottler)
+		want error
+	}{
+		{"Close", func(th *WgThrottler) { th.Close() }, ErrClosed},
+		{"Drain", func(th *WgThrottler) { th.Drain(context.Background()) }, ErrDraining},
+	} {
+		th := NewThrottler(2)
+		user := use(t, th)
+		th.Pause()
+		queued := make(chan error, 2)
+		go func() {
+			queued <- th.Next(user)
+		}()
+		go func() {
+			_, err := th.AcquireMulti(context.Background(), user, user)
+			queued <- err
+		}()
+		waitQueued(th, 3)
+
+		tc.stop(th)
+		for i := 0; i < 2; i++ {
+			if err := <-queued; err != tc.want {
+				t.Errorf("%s: expected the queued call to fail with %v, got %v", tc.name, tc.want, err)
+			}
+		}
+		if n := th.Len(); n != 0 {
+			t.Errorf("%s: expected no slot granted on the way out, %d in use", tc.name, n)
+		}
+	}
+}
+
+func TestDrainCanceled(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	th.Next(user)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := th.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if s := th.State(); s != Draining {
+		t.Errorf("expected the throttler to be left draining, got %v", s)
+	}
+	th.Close()
+	if s := th.State(); s != Closed {
+		t.Errorf("expected Close to finish the drain, got %v", s)
+	}
+}
+
+func TestRounding(t *testing.T) {
+	// seven slots between three users: a share of two and a third, taken by each user in turn
+	for _, tc := range []struct {
+		rounding Rounding
+		held     []int
+	}{
+		{Ceil, []int{3, 3, 1}},
+		{Floor, []int{2, 2, 2}},
+		{Strict, []int{3, 2, 2}},
+	} {
+		th, users := NewThrottlerWithUsers(7, 3, WithRounding(tc.rounding))
+		held := make([]int, len(users))
+		for i, user := range users {
+			for th.TryNext(user) == nil {
+				held[i]++
+			}
+		}
+		if fmt.Sprint(held) != fmt.Sprint(tc.held) {
+			t.Errorf("rounding %d: expected %v slots held, got %v", tc.rounding, tc.held, held)
+		}
+	}
+}
+
+func TestStrictRoundingReleasesExtra(t *testing.T) {
+	th, users := NewThrottlerWithUsers(7, 3, WithRounding(Strict))
+	for th.TryNext(users[0]) == nil {
+	}
+	// the extra slot is only claimed by another user once its holder gives it up
+	th.Next(users[1])
+	th.Next(users[1])
+	if err := th.TryNext(users[1]); err != ErrWouldBlock {
+		t.Fatalf("expected the remainder to be taken, got %v", err)
+	}
+	th.Done(users[0])
+	if err := th.TryNext(users[1]); err != nil {
+		t.Errorf("expected the returned extra slot to be claimable, got %v", err)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	th := NewThrottler(2)
+	clock := useFakeClock(th)
+	user := use(t, th)
+	if !th.Healthy(time.Second) {
+		t.Fatal("expected an idle throttler to be healthy")
+	}
+
+	th.Next(user)
+	clock.Advance(time.Minute)
+	th.Next(user)
+	clock.Advance(time.Second)
+	if !th.Healthy(time.Second) {
+		t.Error("expected the pool to be healthy until saturated for longer than the threshold")
+	}
+	clock.Advance(time.Millisecond)
+	if th.Healthy(time.Second) {
+		t.Error("expected the pool to be unhealthy once saturated for longer than the threshold")
+	}
+
+	// a returned slot restores health, and the clock starts over once the pool fills up again
+	th.Done(user)
+	if !th.Healthy(time.Second) {
+		t.Error("expected the pool to be healthy with a free slot")
+	}
+	th.Next(user)
+	clock.Advance(time.Second)
+	if !th.Healthy(time.Second) {
+		t.Error("expected the refilled pool to be healthy within the threshold")
+	}
+}
+
+func TestNoFairDivision(t *testing.T) {
+	th, users := NewThrottlerWithUsers(4, 4, WithNoFairDivision())
+	for i := 0; i < 4; i++ {
+		if err := th.TryNext(users[0]); err != nil {
+			t.Fatalf("expected a single user to take the whole pool, got %v after %d slots", err, i)
+		}
+	}
+	if err := th.TryNext(users[1]); err != ErrWouldBlock {
+		t.Errorf("expected the full pool to reject other users, got %v", err)
+	}
+	if s := th.Stats(); s.Users != 4 || s.Held[1] != 4 {
+		t.Errorf("expected users to be tracked as usual, got %+v", s)
+	}
+
+	th.Done(users[0])
+	if err := th.UserSetMax(users[1], 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.TryNext(users[1]); err != nil {
+		t.Fatalf("expected the freed slot to be granted, got %v", err)
+	}
+	th.Done(users[0])
+	if err := th.TryNext(users[1]); err != ErrWouldBlock {
+		t.Errorf("expected the user's ceiling to still apply, got %v", err)
+	}
+}
+
+func TestNextNExceedsCeiling(t *testing.T) {
+	// a fixed share of one slot can never hold two at once, however idle the pool is
+	th, users := NewThrottlerWithUsers(4, 4)
+	if err := th.NextN(users[0], 2); err != ErrExceedsMax {
+		t.Errorf("expected ErrExceedsMax beyond the fixed share, got %v", err)
+	}
+
+	th = NewThrottler(4)
+	user, other := use(t, th), use(t, th)
+	th.UserSetMax(user, 1)
+	if err := th.NextN(user, 2); err != ErrExceedsMax {
+		t.Errorf("expected ErrExceedsMax beyond the user's ceiling, got %v", err)
+	}
+	if _, err := th.AcquireMulti(context.Background(), user, user, other); err != ErrExceedsMax {
+		t.Errorf("expected ErrExceedsMax for a user listed beyond its ceiling, got %v", err)
+	}
+
+	// lowering the ceiling gives up on a call already waiting for more than it allows
+	th.UserSetMax(user, 2)
+	th.NextN(other, 3)
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.NextN(user, 2)
+	}()
+	waitQueued(th, 2)
+	th.UserSetMax(user, 1)
+	if err := <-acquired; err != ErrExceedsMax {
+		t.Errorf("expected ErrExceedsMax once the ceiling was lowered, got %v", err)
+	}
+}
+
+func TestImmediateGrantWithCancelableContext(t *testing.T) {
+	th := NewThrottler(1)
+	user := use(t, th)
+	ctx, cancel := context.WithCancel(user)
+	defer cancel()
+	cycle := func(ctx context.Context) func() {
+		return func() {
+			if err := th.Next(ctx); err != nil {
+				t.Fatal(err)
+			}
+			th.Done(ctx)
+		}
+	}
+	// a caller admitted right away must not register anything to wake it on cancelation
+	plain, cancelable := testing.AllocsPerRun(100, cycle(user)), testing.AllocsPerRun(100, cycle(ctx))
+	if cancelable != plain {
+		t.Errorf("expected a cancelable context to cost nothing extra when granted right away, got %v allocations rather than %v", cancelable, plain)
+	}
+}
+
+func TestCompletedCountsCalls(t *testing.T) {
+	th := NewThrottler(4)
+	user := use(t, th)
+	if err := th.NextN(user, 3); err != nil {
+		t.Fatal(err)
+	}
+	// lowering the weight of a running task doesn't finish it
+	if err := th.Downgrade(user, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := th.Completed(); n != 0 {
+		t.Fatalf("expected Downgrade not to count as a completion, got %d", n)
+	}
+	if err := th.DoneN(user, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := th.Completed(); n != 1 {
+		t.Errorf("expected a weighted task to count as a single completion, got %d", n)
+	}
+}
+
+func BenchmarkManyUsers(b *testing.B) {
+	th := NewThrottler(200)
+	users := make([]context.Context, 100)
+	for i := range users {
+		users[i], _ = th.Use()
+	}
+
+	var next int64
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		user := users[atomic.AddInt64(&next, 1)%int64(len(users))]
+		for pb.Next() {
+			th.Next(user)
+			// hand the slot back from another goroutine so that callers queue up behind the max
+			go th.Done(user)
+		}
+	})
+}
+
+func TestWFQLateJoiner(t *testing.T) {
+	th := NewThrottler(1, WithWFQ())
+	clock := useFakeClock(th)
+	old := use(t, th)
+	th.Next(old)
+	clock.Advance(time.Hour)
+	th.Done(old)
+
+	// a user joining while the old one is active starts level with it, rather than an hour behind
+	th.Next(old)
+	late := use(t, th)
+	queued := make(chan error)
+	go func() {
+		queued <- th.Next(late)
+	}()
+	waitQueued(th, 1)
+	th.Lock()
+	if s := th.service[2]; s != time.Hour {
+		t.Errorf("expected the late user to start at an hour of service, got %v", s)
+	}
+	th.Unlock()
+	clock.Advance(time.Second)
+	th.Done(old)
+	<-queued
+	th.Done(late)
+
+	th.Reset()
+	th.Lock()
+	defer th.Unlock()
+	if n := len(th.service); n != 0 {
+		t.Errorf("expected Reset to clear the service of %d users", n)
+	}
+}
+
+func TestTurnsSkipInadmissibleGroup(t *testing.T) {
+	th := NewThrottler(2)
+	users := make([]context.Context, 3)
+	for i := range users {
+		users[i] = use(t, th)
+		th.Next(users[i])
+		th.Done(users[i])
+	}
+	th.Next(users[0])
+	th.Next(users[1])
+	acquired := make(chan error)
+	go func() {
+		acquired <- th.Next(users[2])
+	}()
+	waitQueued(th, 1)
+
+	// with more active users than slots every share is one, so the group can't be granted, and yielding to it
+	// as the user whose turn it is would leave the freed slot idle
+	ctx, cancel := context.WithCancel(use(t, th))
+	defer cancel()
+	blocked := make(chan error)
+	go func() {
+		blocked <- th.NextN(ctx, 2)
+	}()
+	waitQueued(th, 3)
+	th.Done(users[0])
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the freed slot to be granted, got %v", th)
+	}
+	cancel()
+	<-blocked
+}
+
+func TestWFQSkipsInadmissibleGroup(t *testing.T) {
+	th := NewThrottler(4, WithWFQ())
+	clock := useFakeClock(th)
+	a, b, u := use(t, th), use(t, th), use(t, th)
+	th.Next(b)
+	clock.Advance(time.Second)
+	th.Done(b)
+	th.Next(a)
+
+	// u has the least service, but its share of two can't hold the three slots it asks for
+	ctx, cancel := context.WithCancel(u)
+	blocked := make(chan error)
+	go func() {
+		blocked <- th.NextN(ctx, 3)
+	}()
+	waitQueued(th, 3)
+
+	wait, stop := context.WithTimeout(b, time.Second)
+	defer stop()
+	if err := th.Next(wait); err != nil {
+		t.Errorf("expected b to be granted one of the free slots, got %v with %v", err, th)
+	}
+	cancel()
+	<-blocked
+}
+
+func TestStressManyUsers(t *testing.T) {
+	const users, rounds, max = 50, 200, 20
+	th := NewThrottler(max)
+	var violations int64
+	th.onGrant = func(int) {
+		if th.total > max {
+			atomic.AddInt64(&violations, 1)
+		}
+	}
+
+	var done, tasks sync.WaitGroup
+	for i := 0; i < users; i++ {
+		user := use(t, th)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			// every user must make it through all of its rounds, or the test times out
+			for j := 0; j < rounds; j++ {
+				th.Next(user)
+				tasks.Add(1)
+				go func() {
+					defer tasks.Done()
+					th.Done(user)
+				}()
+			}
+		}()
+	}
+	done.Wait()
+	tasks.Wait()
+
+	if violations > 0 {
+		t.Errorf("global max exceeded %d times", violations)
+	}
+	if n := th.Completed(); n != users*rounds {
+		t.Errorf("expected %d completions, got %d", users*rounds, n)
+	}
+}